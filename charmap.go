@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Charmap однобайтовая кодировка: первые 128 символов совпадают с ASCII,
+// для верхней половины (0x80-0xFF) задана таблица символов Unicode.
+type Charmap struct {
+	name   string
+	high   [128]rune
+	encode map[rune]byte
+}
+
+func newCharmap(name string, high [128]rune) *Charmap {
+	cm := &Charmap{name: name, high: high, encode: make(map[rune]byte, 128)}
+	for i, r := range high {
+		if r != utf8.RuneError {
+			cm.encode[r] = byte(0x80 + i)
+		}
+	}
+	return cm
+}
+
+// Decode переводит строку из однобайтовой кодировки в UTF-8.
+func (cm *Charmap) Decode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b < 0x80 {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteRune(cm.high[b-0x80])
+		}
+	}
+	return sb.String()
+}
+
+// Encode переводит строку UTF-8 в однобайтовую кодировку,
+// символы, отсутствующие в кодировке, заменяются на '?'.
+func (cm *Charmap) Encode(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if r < 0x80 {
+			sb.WriteByte(byte(r))
+			continue
+		}
+		b, ok := cm.encode[r]
+		if !ok {
+			b = '?'
+		}
+		sb.WriteByte(b)
+	}
+	return sb.String()
+}
+
+func latin1() [128]rune {
+	var high [128]rune
+	for i := range high {
+		high[i] = rune(0x80 + i)
+	}
+	return high
+}
+
+func windows1251() [128]rune {
+	high := [128]rune{
+		0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+		0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+		0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+		utf8.RuneError, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+		0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+		0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+		0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+		0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+	}
+	// 0xC0-0xFF: А-я подряд
+	for i := 0x40; i < 0x80; i++ {
+		high[i] = rune(0x0410 + i - 0x40)
+	}
+	return high
+}
+
+var charmaps map[string]*Charmap = map[string]*Charmap{
+	"latin1":       newCharmap("latin1", latin1()),
+	"iso-8859-1":   newCharmap("latin1", latin1()),
+	"cp1251":       newCharmap("cp1251", windows1251()),
+	"windows-1251": newCharmap("cp1251", windows1251()),
+}
+
+// lookupCharmap возвращает кодировку по имени, nil означает UTF-8.
+func lookupCharmap(name string) (*Charmap, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == "utf-8" || name == "utf8" {
+		return nil, nil
+	}
+	cm, ok := charmaps[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	return cm, nil
+}
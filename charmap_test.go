@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCharmapRoundTrip(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		encoded  string
+	}{
+		{"cp1251", "Привет, мир!", "\xcf\xf0\xe8\xe2\xe5\xf2, \xec\xe8\xf0!"},
+		{"windows-1251", "Ёжик №1 — «да»", "\xa8\xe6\xe8\xea \xb91 \x97 \xab\xe4\xe0\xbb"},
+		{"latin1", "café naïve", "caf\xe9 na\xefve"},
+		{"iso-8859-1", "£5 ±1", "\xa35 \xb11"},
+		// символ, которого нет в кодировке, заменяется на '?'
+		{"latin1", "Жuk", "?uk"},
+	}
+	for _, tt := range tests {
+		cm, err := lookupCharmap(tt.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cm.Encode(tt.text); got != tt.encoded {
+			t.Errorf("%s: Encode(%q) = %q, want %q", tt.encoding, tt.text, got, tt.encoded)
+		}
+	}
+
+	// каждый определенный байт верхней половины переживает Decode и Encode
+	for _, name := range []string{"cp1251", "latin1"} {
+		cm, _ := lookupCharmap(name)
+		for b := 0x80; b <= 0xff; b++ {
+			s := string([]byte{byte(b)})
+			decoded := cm.Decode(s)
+			if decoded == "�" {
+				continue
+			}
+			if got := cm.Encode(decoded); got != s {
+				t.Errorf("%s: byte %#x decodes to %q and encodes back to %q", name, b, decoded, got)
+			}
+		}
+	}
+}
+
+func TestCharmapFileRoundTrip(t *testing.T) {
+	for _, name := range []string{"cp1251", "latin1"} {
+		cm, _ := lookupCharmap(name)
+		lines := []string{"plain ascii", cm.Decode("\xc0\xe1\xe2\xff"), ""}
+		fn := filepath.Join(t.TempDir(), name+".txt")
+		if err := writeFile(fn, lines, writeOptions{enc: cm}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "plain ascii\n\xc0\xe1\xe2\xff\n\n"; string(data) != want {
+			t.Errorf("%s: file contents %q, want %q", name, data, want)
+		}
+		got, _, err := readFile(fn, readOptions{enc: cm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, lines) {
+			t.Errorf("%s: readFile() = %q, want %q", name, got, lines)
+		}
+	}
+}
+
+func TestLookupCharmap(t *testing.T) {
+	for _, name := range []string{"", "utf-8", "UTF8"} {
+		if cm, err := lookupCharmap(name); cm != nil || err != nil {
+			t.Errorf("lookupCharmap(%q) = %v, %v; want UTF-8", name, cm, err)
+		}
+	}
+	if _, err := lookupCharmap("koi8-r"); err == nil {
+		t.Error("lookupCharmap(\"koi8-r\") succeeded, want error")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// diffLine строка результата сравнения двух текстов:
+// op ' ' - строка есть в обоих текстах, '-' - только в старом, '+' - только в новом
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines сравнивает тексты a (старый) и b (новый) построчно алгоритмом
+// Майерса. Общие начало и конец текстов отбрасываются сразу, а остаток делится
+// в точке кратчайшего пути редактирования и сравнивается по частям, поэтому
+// память линейна по длине текстов, а не пропорциональна их произведению.
+func diffLines(a, b []string) []diffLine {
+	return appendDiff(make([]diffLine, 0, max(len(a), len(b))), a, b)
+}
+
+// appendDiff добавляет к diff результат сравнения a и b.
+func appendDiff(diff []diffLine, a, b []string) []diffLine {
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		diff = append(diff, diffLine{' ', a[p]})
+		p++
+	}
+	a, b = a[p:], b[p:]
+	s := 0
+	for s < len(a) && s < len(b) && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	suffix := a[len(a)-s:]
+	a, b = a[:len(a)-s], b[:len(b)-s]
+
+	if x, y, ok := middleSnake(a, b); ok {
+		diff = appendDiff(diff, a[:x], b[:y])
+		diff = appendDiff(diff, a[x:], b[y:])
+	} else {
+		for _, line := range a {
+			diff = append(diff, diffLine{'-', line})
+		}
+		for _, line := range b {
+			diff = append(diff, diffLine{'+', line})
+		}
+	}
+	for _, line := range suffix {
+		diff = append(diff, diffLine{' ', line})
+	}
+	return diff
+}
+
+// middleSnake ищет точку (x, y), через которую проходит кратчайший путь
+// редактирования a в b, встречными поисками от начала и от конца текстов.
+// ok = false, если у текстов нет общих строк (или один из них пуст).
+func middleSnake(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	// forward[offset+k], backward[offset+k] - самая дальняя позиция x на диагонали k
+	// прямого поиска от начала и обратного поиска от конца; -1 - не достигнута
+	offset := maxD
+	forward := make([]int, 2*maxD+1)
+	backward := make([]int, 2*maxD+1)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// при нечетной разнице длин пути встречаются на шаге прямого поиска
+	front := delta%2 != 0
+	// границы диагоналей, еще не вышедших за пределы текстов
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 && x >= n-backward[j] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !front:
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 && forward[j] >= n-x {
+					fx := forward[j]
+					return fx, fx - (delta - k), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// mapLines сопоставляет строки старого текста a строкам нового текста b:
+// для каждой строки a - ее индекс в b или -1, если строка удалена. Блок
+// изменений, где удалено столько же строк, сколько вставлено, считается
+// правкой этих строк на месте, и они сопоставляются по порядку.
+func mapLines(a, b []string) []int {
+	pos := make([]int, len(a))
+	diff := diffLines(a, b)
+	i, j := 0, 0
+	for k := 0; k < len(diff); {
+		if diff[k].op == ' ' {
+			pos[i] = j
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+		del, ins := 0, 0
+		for ; k < len(diff) && diff[k].op != ' '; k++ {
+			if diff[k].op == '-' {
+				del++
+			} else {
+				ins++
+			}
+		}
+		for d := range del {
+			pos[i+d] = -1
+			if del == ins {
+				pos[i+d] = j + d
+			}
+		}
+		i, j = i+del, j+ins
+	}
+	return pos
+}
+
+// writeHunks печатает изменения в формате unified diff: блоки @@ -l,n +l,n @@
+// с context строками контекста вокруг измененных строк.
+func writeHunks(w io.Writer, diff []diffLine, context int) {
+	// oldBefore[i], newBefore[i] - число строк старого и нового текста перед diff[i]
+	oldBefore := make([]int, len(diff)+1)
+	newBefore := make([]int, len(diff)+1)
+	for i, d := range diff {
+		oldBefore[i+1], newBefore[i+1] = oldBefore[i], newBefore[i]
+		if d.op != '+' {
+			oldBefore[i+1]++
+		}
+		if d.op != '-' {
+			newBefore[i+1]++
+		}
+	}
+
+	for i := 0; i < len(diff); {
+		if diff[i].op == ' ' {
+			i++
+			continue
+		}
+		// блок продолжается, пока промежутки между изменениями не длиннее 2*context
+		end := i
+		for j := i; j < len(diff); {
+			if diff[j].op != ' ' {
+				j++
+				end = j
+				continue
+			}
+			k := j
+			for k < len(diff) && diff[k].op == ' ' {
+				k++
+			}
+			if k == len(diff) || k-j > 2*context {
+				break
+			}
+			j = k
+		}
+		start := max(i-context, 0)
+		stop := min(end+context, len(diff))
+
+		oldStart, oldCount := oldBefore[start], oldBefore[stop]-oldBefore[start]
+		newStart, newCount := newBefore[start], newBefore[stop]-newBefore[start]
+		if oldCount > 0 {
+			oldStart++
+		}
+		if newCount > 0 {
+			newStart++
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, d := range diff[start:stop] {
+			fmt.Fprintf(w, "%c%s\n", d.op, d.text)
+		}
+		i = stop
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lcsLength длина наибольшей общей подпоследовательности a и b (квадратичная
+// память, только для проверки на коротких текстах).
+func lcsLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+func TestDiffLines(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	text := func() []string {
+		lines := make([]string, rnd.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + rnd.Intn(4)))
+		}
+		return lines
+	}
+	for range 2000 {
+		a, b := text(), text()
+		diff := diffLines(a, b)
+		var old, new []string
+		common := 0
+		for _, d := range diff {
+			if d.op != '+' {
+				old = append(old, d.text)
+			}
+			if d.op != '-' {
+				new = append(new, d.text)
+			}
+			if d.op == ' ' {
+				common++
+			}
+		}
+		if strings.Join(old, ",") != strings.Join(a, ",") || strings.Join(new, ",") != strings.Join(b, ",") {
+			t.Fatalf("diffLines(%q, %q) = %v does not reproduce the texts", a, b, diff)
+		}
+		if want := lcsLength(a, b); common != want {
+			t.Fatalf("diffLines(%q, %q) keeps %d common lines, want %d", a, b, common, want)
+		}
+	}
+}
+
+func TestWriteHunks(t *testing.T) {
+	a := strings.Split("1 2 3 4 5 6 7 8 9", " ")
+	b := strings.Split("1 2 x 4 5 6 7 8 9 10", " ")
+	var sb strings.Builder
+	writeHunks(&sb, diffLines(a, b), 1)
+	want := "@@ -2,3 +2,3 @@\n 2\n-3\n+x\n 4\n@@ -9,1 +9,2 @@\n 9\n+10\n"
+	if sb.String() != want {
+		t.Errorf("writeHunks() = %q, want %q", sb.String(), want)
+	}
+}
+
+// BenchmarkDiffLines сравнивает два файла по 10000 строк, различающихся
+// в каждой сотой строке.
+func BenchmarkDiffLines(b *testing.B) {
+	old := make([]string, 10000)
+	new := make([]string, len(old))
+	for i := range old {
+		old[i] = strings.Repeat("x", i%50) + string(rune('a'+i%26))
+		new[i] = old[i]
+		if i%100 == 0 {
+			new[i] += " changed"
+		}
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		diffLines(old, new)
+	}
+}
+
+func TestMapLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []int
+	}{
+		{"a b c", "a b c", []int{0, 1, 2}},
+		{"a b c", "x a b c", []int{1, 2, 3}},
+		{"a b c", "a c", []int{0, -1, 1}},
+		// правка на месте сохраняет соответствие строк
+		{"a b c", "a B c", []int{0, 1, 2}},
+		{"a b c", "A B", []int{-1, -1, -1}},
+		{"a b a", "a b a x", []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		got := mapLines(strings.Fields(tt.a), strings.Fields(tt.b))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("mapLines(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
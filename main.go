@@ -2,12 +2,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -31,260 +46,3407 @@ type Command struct {
 type State struct {
 	mode Mode
 	in   *bufio.Reader
+	// ввод данных для r -, nil - данные читаются из in
+	data *bufio.Reader
 
 	// буфер текста
 	buffer []string
 	// буфер изменен с момента последнего сохранения в файл
 	changed bool
+	// счетчик изменений строк буфера, по нему autoPrint узнает, что команда
+	// изменила буфер
+	edits int
+	// после команды, изменившей буфер, печатать текущую строку (o autoprint)
+	autoPrint bool
+
+	// текущая строка (начиная с 1), 0 - буфер пуст
+	current int
+	// текущая строка до последнего перехода больше чем на одну строку (адрес ''),
+	// 0 - переходов не было
+	prevLine int
+	// в режиме добавления строки вставляются после строки insertAt
+	insertAt int
+	// идет вставка текста из буфера обмена (bracketed paste)
+	pasting bool
 
 	// флаг отображения номеров строк
 	lineNumbers bool
 
 	// путь к открытому файлу
 	filename string
+	// в буфер загружена только часть файла (e +N, e -N)
+	partial bool
+	// при записи завершать строки CRLF вместо LF (L crlf); при чтении файла
+	// устанавливается, если в нем больше строк с CRLF, чем с LF
+	crlf bool
+	// окончания строк файла, подсчитанные при его чтении (печатает L)
+	endings endingCounts
+	// при записи сохранять прежний файл в filename~ (-b)
+	backup bool
+
+	// кодировка файлов, nil - UTF-8
+	encoding *Charmap
+
+	// выполняется команда; устанавливается на время HandleCommand
+	running atomic.Bool
+	// выполняется G: команды для его строк не могут запускать G
+	global bool
+	// получен SIGINT во время выполнения команды
+	interrupted atomic.Bool
+	// выполняет команды оболочки (r !, e !, Z), nil - runShell
+	shell func(cmdline string) ([]string, error)
+
+	// журнал выполненных команд (-j), nil - журнал не ведется
+	journal io.Writer
+	// строки, прочитанные командой во время выполнения (ответы G, y/n, данные r -);
+	// пишутся в журнал вслед за строкой самой команды
+	answers [][]byte
+	// строки ввода читаются из файла runScript (журнала, начальных команд):
+	// данные r - в нем завершаются строкой "."
+	scripted bool
+
+	// последний использованный шаблон регулярного выражения
+	lastPattern *regexp.Regexp
+	// скомпилированные шаблоны регулярных выражений
+	patterns patternCache
+	// поиск /re/ и ?re? продолжается с другого конца буфера
+	searchWrap bool
+	// формат времени для %d в команде T (см. time.Layout)
+	timeFormat string
+	// при печати обрезать строки до ширины экрана displayWidth
+	fold         bool
+	displayWidth int
+	// ширина табуляции при расчете позиций на экране (fold, W, N i)
+	tabWidth int
+	// безопасный режим: изменение больше safeLines строк одной командой требует подтверждения
+	safe      bool
+	safeLines int
+	// печатать в stderr ход долгих команд над диапазоном (F, G, X, U)
+	progress bool
+	// печатающие команды (printCommands) на пустом буфере не сообщают об ошибке
+	quietEmpty bool
+	// буфер только для чтения: команды modifying не выполняются
+	readOnly bool
+	// приглашение командного режима и режима добавления, пустое - не печатается
+	prompt      string
+	inputPrompt string
+
+	// псевдонимы команд: имя -> текст команды
+	aliases map[string]string
+
+	// история выполненных команд, historyBase - число вытесненных из нее записей
+	history     []string
+	historyBase int
+
+	// имя активного буфера и неактивные буферы по именам
+	bufferName string
+	buffers    map[string]*bufferState
+}
+
+// bufferState документ, отложенный при переключении на другой буфер.
+// Поля активного документа хранятся непосредственно в State.
+type bufferState struct {
+	lines    []string
+	filename string
+	changed  bool
+	current  int
+	prevLine int
+	partial  bool
+	crlf     bool
+	endings  endingCounts
+	readOnly bool
 }
 
-func (state *State) quit([]string) error {
-	state.mode = modeQuit
+// defaultBuffer имя буфера, с которым запускается редактор
+const defaultBuffer = "main"
+
+// switchBuffer переключает редактор на буфер name (создавая пустой при необходимости),
+// без имени печатает список буферов: * - активный, + - измененный.
+func (state *State) switchBuffer(args []string) error {
+	if state.buffers == nil {
+		state.buffers = make(map[string]*bufferState)
+	}
+	if len(state.bufferName) == 0 {
+		state.bufferName = defaultBuffer
+	}
+	active := &bufferState{
+		lines:    state.buffer,
+		filename: state.filename,
+		changed:  state.changed,
+		current:  state.current,
+		prevLine: state.prevLine,
+		partial:  state.partial,
+		crlf:     state.crlf,
+		endings:  state.endings,
+		readOnly: state.readOnly,
+	}
+
+	if len(args) < 3 {
+		names := make([]string, 0, len(state.buffers)+1)
+		names = append(names, state.bufferName)
+		for name := range state.buffers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			buf, mark := state.buffers[name], " "
+			if name == state.bufferName {
+				buf, mark = active, "*"
+			}
+			modified := " "
+			if buf.changed {
+				modified = "+"
+			}
+			fmt.Printf("%s%s %-10s %6d %s\n", mark, modified, name, len(buf.lines), buf.filename)
+		}
+		return nil
+	}
+
+	name := args[2]
+	if name == state.bufferName {
+		return nil
+	}
+	next, ok := state.buffers[name]
+	if !ok {
+		next = &bufferState{}
+	}
+	delete(state.buffers, name)
+	state.buffers[state.bufferName] = active
+
+	state.bufferName = name
+	state.buffer = next.lines
+	state.filename = next.filename
+	state.changed = next.changed
+	state.current = next.current
+	state.prevLine = next.prevLine
+	state.partial = next.partial
+	state.crlf = next.crlf
+	state.endings = next.endings
+	state.readOnly = next.readOnly
 	return nil
 }
 
-// Одиночная команда . (точка) завершает режим редактирования.
-func (state *State) dot([]string) error {
-	state.mode = modeCommand
+// progressInterval как часто печатается ход долгой команды; команда,
+// завершившаяся быстрее, ничего не печатает. Тесты уменьшают его.
+var progressInterval = time.Second
+
+// progressMeter печатает в stderr "processed N/M lines" не чаще раза
+// в progressInterval. Нулевой указатель ничего не печатает.
+type progressMeter struct {
+	total int
+	next  time.Time
+}
+
+// newProgress возвращает счетчик хода команды над total строками
+// или nil, если вывод хода отключен (o progress).
+func (state *State) newProgress(total int) *progressMeter {
+	if !state.progress {
+		return nil
+	}
+	return &progressMeter{total: total, next: time.Now().Add(progressInterval)}
+}
+
+// update сообщает, что обработано n строк. Время проверяется раз в 1024 строки.
+func (p *progressMeter) update(n int) {
+	if p == nil || n%1024 != 0 {
+		return
+	}
+	if now := time.Now(); now.After(p.next) {
+		fmt.Fprintf(os.Stderr, "processed %d/%d lines\n", n, p.total)
+		p.next = now.Add(progressInterval)
+	}
+}
+
+// errEmptyBuffer возвращается командой, которой нужны строки, при пустом буфере
+var errEmptyBuffer = errors.New("text buffer is empty!")
+
+// printCommands команды, которые только печатают строки буфера; при включенной
+// настройке quietempty на пустом буфере они ничего не делают вместо ошибки
+var printCommands map[byte]bool = map[byte]bool{'p': true, '#': true, 'F': true, 'B': true, 'v': true}
+
+// errReadOnly возвращается командой, изменяющей буфер или файлы, в режиме только для чтения
+var errReadOnly = errors.New("buffer is read-only")
+
+// modifying команды, изменяющие буфер или записывающие файлы; в режиме только
+// для чтения (o readonly) они не выполняются. L, k и U меняют буфер не при
+// всех аргументах и проверяют режим сами.
+var modifying map[byte]bool = map[byte]bool{
+	'a': true, 'r': true, 'R': true, 'Y': true, 'T': true, 'n': true, 'E': true,
+	'd': true, 'j': true, 'S': true, 'W': true, 'N': true, 'X': true,
+	'C': true, 'I': true, 'K': true, 'J': true, 'P': true, 'Q': true, '~': true,
+	'z': true, 'Z': true, 't': true, 'w': true, 'V': true, 'O': true, 'x': true,
+}
+
+// errInterrupted возвращается командой, прерванной по SIGINT
+var errInterrupted = errors.New("interrupted")
+
+// watchInterrupt обрабатывает SIGINT: прерывает выполняемую команду вместо завершения
+// редактора, а в командной строке только предупреждает о несохраненных изменениях.
+func (state *State) watchInterrupt(sigs <-chan os.Signal) {
+	for range sigs {
+		if state.running.Load() {
+			state.interrupted.Store(true)
+			continue
+		}
+		fmt.Printf("\n?\n")
+		if state.changed {
+			fmt.Printf("warning: buffer modified, use w to save or q to quit\n")
+		}
+	}
+}
+
+func (state *State) quit([]string) error {
+	state.mode = modeQuit
 	return nil
 }
 
-func (state *State) append([]string) error {
+// append переходит в режим добавления: вводимые строки вставляются после
+// адресованной строки (0 - в начало буфера), по умолчанию - в конец буфера.
+func (state *State) append(args []string) error {
+	after, err := state.destination(args)
+	if err != nil {
+		return err
+	}
+	// (addr)a\text вставляет текст сразу, без перехода в режим добавления
+	if len(args) > 2 && strings.HasPrefix(args[2], "\\") {
+		state.insertLines(after, unescapeLines(args[2][1:]))
+		return nil
+	}
+	state.insertAt = after
 	state.mode = modeAppend
 	return nil
 }
 
+// unescapeLines раскрывает в text последовательности \n (перевод строки, разделяет
+// вставляемые строки), \t (табуляция) и \\ (обратная косая черта).
+// Пустой text - одна пустая строка.
+func unescapeLines(text string) []string {
+	var lines []string
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 == len(text) {
+			sb.WriteByte(text[i])
+			continue
+		}
+		i++
+		switch text[i] {
+		case 'n':
+			lines = append(lines, sb.String())
+			sb.Reset()
+		case 't':
+			sb.WriteByte('\t')
+		case '\\':
+			sb.WriteByte('\\')
+		default:
+			sb.WriteByte('\\')
+			sb.WriteByte(text[i])
+		}
+	}
+	return append(lines, sb.String())
+}
+
 func (state *State) numbers([]string) error {
 	state.lineNumbers = !state.lineNumbers
 	return nil
 }
 
-// new очищает текстовый буфер без сохранения, создает новый документ
-// TODO проверять буфер, предлагать сохранение
-func (state *State) new([]string) error {
-	state.buffer = nil
+// status печатает сводку о буфере: имя файла, число строк, текущую строку,
+// признак изменения, кодировку и окончания строк.
+func (state *State) status([]string) error {
+	name := state.filename
+	if len(name) == 0 {
+		name = "(no file)"
+	}
+	modified := "unmodified"
+	if state.changed {
+		modified = "modified"
+	}
+	if state.partial {
+		modified += ", partial"
+	}
+	encoding := "utf-8"
+	if state.encoding != nil {
+		encoding = state.encoding.name
+	}
+	eol := "LF"
+	if state.crlf {
+		eol = "CRLF"
+	}
+	fmt.Printf("%s: %d lines, line %d, %s, %s, %s\n", name, len(state.buffer), state.current, modified, encoding, eol)
 	return nil
 }
 
-func (state *State) print(args []string) error {
-	if len(state.buffer) == 0 {
-		return errors.New("text buffer is empty!")
+// lineEndings печатает, сколько строк файла при чтении завершались CRLF, LF
+// и одиночным CR. L lf или L crlf приводит окончания строк буфера к одному
+// виду: строки, разделенные одиночным CR, становятся отдельными строками,
+// а при записи строки завершаются выбранным окончанием.
+func (state *State) lineEndings(args []string) error {
+	if len(args) < 3 {
+		if len(state.filename) == 0 {
+			return errors.New("File name undefined!")
+		}
+		fmt.Printf("CRLF %d, LF %d, CR %d\n", state.endings.crlf, state.endings.lf, state.endings.cr)
+		return nil
 	}
-	// в аргументах гарантированно - цифры, поэтому игнорируем ошибку
-	top, _ := strconv.Atoi(args[0])
-	last, _ := strconv.Atoi(args[1])
 
-	top--
-	last--
+	if state.readOnly {
+		return errReadOnly
+	}
+	var crlf bool
+	switch strings.ToLower(args[2]) {
+	case "lf":
+	case "crlf":
+		crlf = true
+	default:
+		return fmt.Errorf("unknown line ending %q", args[2])
+	}
+	lines := make([]string, 0, len(state.buffer))
+	split := 0
+	for _, line := range state.buffer {
+		if !strings.ContainsRune(line, '\r') {
+			lines = append(lines, line)
+			continue
+		}
+		split++
+		lines = append(lines, strings.Split(strings.TrimSuffix(line, "\r"), "\r")...)
+	}
+	if split > 0 {
+		state.buffer = lines
+		state.current = min(state.current, len(lines))
+		state.changed = true
+		state.edits++
+	}
+	if crlf != state.crlf {
+		state.crlf = crlf
+		state.changed = true
+	}
+	fmt.Printf("%d\n", split)
+	return nil
+}
 
-	if top < 0 {
-		top = 0
+// diffContext число строк контекста вокруг изменений в выводе команды D
+const diffContext = 3
+
+// diff печатает отличия буфера от файла на диске (что изменено с последней записи)
+// с context строками контекста (D [context], по умолчанию diffContext). Флаг n
+// (D n) печатает строки диапазона (по умолчанию всего буфера) одним блоком
+// добавленных строк, как новый файл, - для отправки фрагмента на рецензию.
+func (state *State) diff(args []string) error {
+	context, added := diffContext, false
+	for _, arg := range args[2:] {
+		if arg == "n" {
+			added = true
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return errors.New("invalid context")
+		}
+		context = n
 	}
-	if last < 0 {
-		last = top + 1
-	} else {
-		last++
+	if added {
+		top, last, err := state.lineRange(args)
+		if err != nil {
+			return err
+		}
+		name := state.filename
+		if len(name) == 0 {
+			name = "(buffer)"
+		}
+		fmt.Printf("--- /dev/null\n+++ %s\n", name)
+		fmt.Printf("@@ -0,0 +%d,%d @@\n", top, last-top+1)
+		for _, line := range state.buffer[top-1 : last] {
+			fmt.Printf("+%s\n", line)
+		}
+		return nil
 	}
-	if last > len(state.buffer) {
-		last = len(state.buffer)
+	if len(state.filename) == 0 {
+		return errors.New("File name undefined!")
+	}
+	saved, _, err := readFile(state.filename, readOptions{enc: state.encoding, force: true})
+	if err != nil {
+		return err
 	}
+	fmt.Printf("--- %s\n+++ %s (buffer)\n", state.filename, state.filename)
+	writeHunks(os.Stdout, diffLines(saved, state.buffer), context)
+	return nil
+}
 
-	li := top
-	for _, line := range state.buffer[top:last] {
-		if state.lineNumbers {
-			fmt.Printf("%-4d%s\n", li+1, line)
-			li++
-		} else {
-			fmt.Printf("%s\n", line)
+// interactiveGlobal обрабатывает команду G/re/: для каждой строки диапазона
+// (по умолчанию всего буфера), совпадающей с re, печатает строку и выполняет
+// для нее команду, введенную пользователем. Пустая строка пропускает строку,
+// & повторяет предыдущую команду. Команда без адреса относится к этой строке.
+func (state *State) interactiveGlobal(args []string) error {
+	// G из команды для строки (в том числе через псевдоним, H или &) запрещен
+	if state.global {
+		return errors.New("G cannot be nested")
+	}
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("pattern undefined")
+	}
+	re, rest, err := state.pattern(args[2])
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("unexpected command after pattern")
+	}
+
+	var matched []int
+	meter := state.newProgress(last - top + 1)
+	for n := top; n <= last; n++ {
+		meter.update(n - top + 1)
+		if re.MatchString(state.buffer[n-1]) {
+			matched = append(matched, n)
+		}
+	}
+
+	state.global = true
+	defer func() {
+		state.global = false
+	}()
+	var prev string
+	for k, n := range matched {
+		// 0 - строка удалена командой для одной из предыдущих строк
+		if n == 0 {
+			continue
+		}
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		state.current = n
+		fmt.Printf("%s\n", state.buffer[n-1])
+
+		input, err := state.input()
+		if err != nil {
+			return err
+		}
+		cmd := string(input)
+		if len(cmd) == 0 {
+			continue
+		}
+		if cmd == "&" {
+			if len(prev) == 0 {
+				return errors.New("no previous command")
+			}
+			cmd = prev
+		}
+		prev = cmd
+		line, err := state.expandAlias([]byte(cmd))
+		if err != nil {
+			return err
+		}
+		if peekCommand(line) {
+			line = append([]byte("."), line...)
+		}
+
+		before := slices.Clone(state.buffer)
+		err = state.HandleCommand(line)
+		if err != nil {
+			return err
+		}
+		// команда могла вставить или удалить строки где угодно в буфере:
+		// оставшиеся совпадения находятся заново по сравнению буфера до и после
+		if !slices.Equal(before, state.buffer) {
+			moved := mapLines(before, state.buffer)
+			for r := k + 1; r < len(matched); r++ {
+				if matched[r] > 0 {
+					matched[r] = moved[matched[r]-1] + 1
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// grep печатает с номерами строки диапазона (по умолчанию всего буфера),
+// совпадающие с шаблоном F/re/. Буфер и текущая строка не меняются.
+func (state *State) grep(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("pattern undefined")
+	}
+	re, rest, err := state.pattern(args[2])
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("unexpected command after pattern")
+	}
+	meter := state.newProgress(last - top + 1)
+	for n := top; n <= last; n++ {
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		meter.update(n - top + 1)
+		if re.MatchString(state.buffer[n-1]) {
+			fmt.Printf("%-4d%s\n", n, state.buffer[n-1])
+		}
+	}
+	return nil
+}
+
+// purge удаляет за один проход строки диапазона (по умолчанию всего буфера),
+// совпадающие с шаблоном X/re/, а с флагом X/re/v - не совпадающие с ним,
+// и печатает число удаленных строк.
+func (state *State) purge(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("pattern undefined")
+	}
+	re, rest, err := state.pattern(args[2])
+	if err != nil {
+		return err
+	}
+	invert := false
+	switch strings.TrimSpace(rest) {
+	case "":
+	case "v":
+		invert = true
+	default:
+		return errors.New("unexpected command after pattern")
+	}
+
+	kept := make([]string, 0, last-top+1)
+	meter := state.newProgress(last - top + 1)
+	for i, line := range state.buffer[top-1 : last] {
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		meter.update(i + 1)
+		if re.MatchString(line) == invert {
+			kept = append(kept, line)
+		}
+	}
+	removed := last - top + 1 - len(kept)
+	if removed > 0 {
+		state.replaceLines(top, last, kept)
+	}
+	fmt.Printf("%d\n", removed)
+	return nil
+}
+
+// splitPattern выделяет шаблон в начале s, ограниченный первым символом s
+// (/re/ или ?re?), и возвращает его вместе с остатком строки после закрывающего
+// ограничителя. Ограничитель внутри re экранируется \/ (\?). Закрывающий
+// ограничитель в конце строки можно опустить.
+func splitPattern(s string) (string, string, error) {
+	if len(s) == 0 || s[0] != '/' && s[0] != '?' {
+		return "", "", errors.New("pattern undefined")
+	}
+	delim := s[0]
+	var sb strings.Builder
+	i := 1
+	for ; i < len(s) && s[i] != delim; i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == delim {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	rest := ""
+	if i < len(s) {
+		rest = s[i+1:]
+	}
+	return sb.String(), rest, nil
+}
+
+// pattern компилирует шаблон /re/ в начале s и возвращает его вместе с остатком строки.
+// Пустой шаблон // означает последний использованный шаблон.
+//
+// Шаблон всегда применяется к одной строке буфера без символа перевода строки,
+// поэтому ^ и $ совпадают с началом и концом строки, а . не может захватить
+// соседнюю строку. Шаблон компилируется без флагов (?m) и (?s): в строке
+// буфера нет \n, и с ними ^, $ и . вели бы себя так же.
+func (state *State) pattern(s string) (*regexp.Regexp, string, error) {
+	src, rest, err := splitPattern(s)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(src) == 0 {
+		if state.lastPattern == nil {
+			return nil, "", errors.New("no previous pattern")
+		}
+		return state.lastPattern, rest, nil
+	}
+	re, err := state.patterns.compile(src)
+	if err != nil {
+		return nil, "", err
+	}
+	state.lastPattern = re
+	return re, rest, nil
+}
+
+// patternCacheSize сколько скомпилированных шаблонов хранит patternCache
+const patternCacheSize = 32
+
+// patternCache кэш скомпилированных регулярных выражений по тексту шаблона,
+// вытесняющий давно не использованные шаблоны. Нулевое значение готово
+// к работе. Сценарий, повторяющий один и тот же /re/, компилирует его один раз.
+type patternCache struct {
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type patternEntry struct {
+	src string
+	re  *regexp.Regexp
+}
+
+// compile возвращает скомпилированный шаблон src из кэша или компилирует его.
+func (c *patternCache) compile(src string) (*regexp.Regexp, error) {
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+	if e, ok := c.entries[src]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*patternEntry).re, nil
+	}
+	re, err := regexp.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[src] = c.order.PushFront(&patternEntry{src: src, re: re})
+	if c.order.Len() > patternCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*patternEntry).src)
+	}
+	return re, nil
+}
+
+// search ищет от текущей строки ближайшую строку, совпадающую с re: вперед
+// (forward) или назад. С флагом searchWrap поиск продолжается с другого конца
+// буфера, иначе останавливается на его границе. Возвращает -1, если строка не найдена.
+func (state *State) search(re *regexp.Regexp, forward bool) int {
+	size := len(state.buffer)
+	for i := 1; i <= size; i++ {
+		n := state.current - i
+		if forward {
+			n = state.current + i
+		}
+		if n < 1 || n > size {
+			if !state.searchWrap {
+				break
+			}
+			n = (n-1+size)%size + 1
+		}
+		if re.MatchString(state.buffer[n-1]) {
+			return n
+		}
+	}
+	return -1
+}
+
+// delete удаляет строки диапазона (по умолчанию текущую строку).
+// Текущей становится строка после удаленных, а если их нет - последняя строка.
+func (state *State) delete(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	state.replaceLines(top, last, nil)
+	state.current = min(top, len(state.buffer))
+	return nil
+}
+
+// join объединяет строки диапазона в одну (по умолчанию текущую и следующую).
+// С флагом f (j f) пробелы на стыках строк заменяются одним пробелом.
+// Форма j/re/[f] объединяет по отдельности каждую серию строк между строками,
+// совпадающими с re; сами эти строки остаются как есть.
+func (state *State) join(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	var re *regexp.Regexp
+	flags := strings.Join(args[2:], " ")
+	if strings.HasPrefix(flags, "/") {
+		re, flags, err = state.pattern(flags)
+		if err != nil {
+			return err
+		}
+		flags = strings.TrimSpace(flags)
+	}
+	fill := false
+	if len(flags) > 0 {
+		if flags != "f" {
+			return fmt.Errorf("unknown join flag %q", flags)
+		}
+		fill = true
+	}
+	if re != nil {
+		return state.joinBlocks(top, last, re, fill)
+	}
+	if top == last {
+		return nil
+	}
+	lines := state.buffer[top-1 : last]
+	if fill {
+		state.replaceLines(top, last, []string{fillJoin(lines)})
+		return nil
+	}
+	state.replaceLines(top, last, []string{strings.Join(lines, "")})
+	return nil
+}
+
+// joinBlocks объединяет в строках [top, last] каждую серию строк между
+// строками-границами, совпадающими с re, в одну строку; границы сохраняются.
+func (state *State) joinBlocks(top, last int, re *regexp.Regexp, fill bool) error {
+	lines := make([]string, 0, last-top+1)
+	var block []string
+	flush := func() {
+		switch {
+		case len(block) == 0:
+		case fill:
+			lines = append(lines, fillJoin(block))
+		default:
+			lines = append(lines, strings.Join(block, ""))
+		}
+		block = block[:0]
+	}
+	for _, line := range state.buffer[top-1 : last] {
+		if re.MatchString(line) {
+			flush()
+			lines = append(lines, line)
+			continue
+		}
+		block = append(block, line)
+	}
+	flush()
+	if len(lines) < last-top+1 {
+		state.replaceLines(top, last, lines)
+	}
+	return nil
+}
+
+// fillJoin объединяет строки, заменяя пробелы на каждом стыке одним пробелом.
+// Пробел не ставится перед фрагментом, начинающимся со знака препинания
+// (запятая, точка, закрывающая скобка), и на стыке с пустой строкой.
+// Отступ первой строки сохраняется. Решение принимается по началу следующего
+// фрагмента, а не по концу предыдущего: после точки в конце предложения
+// пробел перед следующим словом нужен, а пропадать он должен только перед
+// знаком препинания, перенесенным на новую строку ("word" + ", more").
+func fillJoin(lines []string) string {
+	joined := strings.TrimRight(lines[0], " \t")
+	for _, line := range lines[1:] {
+		line = strings.Trim(line, " \t")
+		if line == "" {
+			continue
+		}
+		if strings.TrimSpace(joined) != "" && !strings.ContainsRune(",.;:!?)]}", []rune(line)[0]) {
+			joined += " "
+		}
+		joined += line
+	}
+	return joined
+}
+
+// ansiEscape управляющие последовательности терминала: CSI (\e[31m, \e[2K),
+// OSC (\e]0;title\a), выбор набора символов (\e(B, его выводит tput sgr0)
+// и двухсимвольные; последним вариантом удаляется одиночный ESC от
+// оборванной последовательности.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()*+][ -~]|\x1b[@-_]|\x1b`)
+
+// normalize нормализует пробелы в строках диапазона. Флаг c (по умолчанию)
+// заменяет серии пробелов и табуляций внутри строки одним пробелом и удаляет
+// пробелы в конце строки, не трогая отступ. Флаг i заменяет отступ из табуляций
+// и пробелов на пробелы с шагом табуляции state.tabWidth. Флаг a удаляет
+// управляющие последовательности терминала (цвета ANSI и т.п.). Без флага c
+// выравнивание внутри строки сохраняется.
+func (state *State) normalize(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	flags := "c"
+	if len(args) > 2 {
+		flags = args[2]
+	}
+	collapse := strings.ContainsRune(flags, 'c')
+	indent := strings.ContainsRune(flags, 'i')
+	ansi := strings.ContainsRune(flags, 'a')
+
+	lines := make([]string, 0, last-top+1)
+	changed := 0
+	for _, line := range state.buffer[top-1 : last] {
+		text := line
+		if ansi {
+			text = ansiEscape.ReplaceAllString(text, "")
+		}
+		body := strings.TrimLeft(text, " \t")
+		lead := text[:len(text)-len(body)]
+		if indent {
+			lead = expandIndent(lead, state.tabWidth)
+		}
+		if collapse {
+			body = strings.Join(strings.Fields(body), " ")
+		}
+		if lead+body != line {
+			changed++
+		}
+		lines = append(lines, lead+body)
+	}
+	if changed > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", changed)
+	return nil
+}
+
+// expandIndent заменяет табуляции в отступе пробелами до следующей позиции табуляции.
+func expandIndent(lead string, tab int) string {
+	return strings.Repeat(" ", columns(lead, tab))
+}
+
+// advance возвращает позицию на экране после символа r, напечатанного в позиции col:
+// табуляция переводит к следующей позиции, кратной tab, остальные символы
+// занимают одну позицию.
+func advance(col int, r rune, tab int) int {
+	if r == '\t' {
+		return col + tab - col%tab
+	}
+	return col + 1
+}
+
+// columns возвращает ширину строки на экране с учетом табуляции шириной tab.
+func columns(s string, tab int) int {
+	col := 0
+	for _, r := range s {
+		col = advance(col, r, tab)
+	}
+	return col
+}
+
+// option показывает или изменяет настройку редактора: o name [value].
+// Без аргументов печатает все настройки, логическая настройка без значения
+// переключается. Значения prompt, inputprompt и timefmt берутся как есть,
+// вместе с пробелами в конце (o prompt > ).
+func (state *State) option(args []string) error {
+	if len(args) < 3 {
+		fmt.Printf("wrap %t\n", state.searchWrap)
+		fmt.Printf("timefmt %s\n", state.timeFormat)
+		fmt.Printf("fold %t\n", state.fold)
+		fmt.Printf("width %d\n", state.displayWidth)
+		fmt.Printf("tabwidth %d\n", state.tabWidth)
+		fmt.Printf("safe %t\n", state.safe)
+		fmt.Printf("safelines %d\n", state.safeLines)
+		fmt.Printf("progress %t\n", state.progress)
+		fmt.Printf("quietempty %t\n", state.quietEmpty)
+		fmt.Printf("readonly %t\n", state.readOnly)
+		fmt.Printf("autoprint %t\n", state.autoPrint)
+		fmt.Printf("prompt %q\n", state.prompt)
+		fmt.Printf("inputprompt %q\n", state.inputPrompt)
+		return nil
+	}
+	name, value := args[2], ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, value = name[:i], strings.TrimLeft(name[i:], " \t")
+	}
+	fields := strings.Fields(value)
+	switch name {
+	case "wrap":
+		return setBool(&state.searchWrap, fields)
+	case "timefmt":
+		if len(fields) == 0 {
+			return errors.New("time format undefined")
+		}
+		state.timeFormat = value
+		return nil
+	case "fold":
+		return setBool(&state.fold, fields)
+	case "width":
+		return setInt(&state.displayWidth, fields)
+	case "tabwidth":
+		return setInt(&state.tabWidth, fields)
+	case "safe":
+		return setBool(&state.safe, fields)
+	case "safelines":
+		return setInt(&state.safeLines, fields)
+	case "progress":
+		return setBool(&state.progress, fields)
+	case "autoprint":
+		return setBool(&state.autoPrint, fields)
+	case "readonly":
+		return setBool(&state.readOnly, fields)
+	case "quietempty":
+		return setBool(&state.quietEmpty, fields)
+	case "prompt":
+		state.prompt = value
+		return nil
+	case "inputprompt":
+		state.inputPrompt = value
+		return nil
+	}
+	return fmt.Errorf("unknown option %q", name)
+}
+
+// setBool переключает логическую настройку или устанавливает ее из значения on/off.
+func setBool(opt *bool, value []string) error {
+	if len(value) == 0 {
+		*opt = !*opt
+		return nil
+	}
+	switch value[0] {
+	case "on", "true", "1":
+		*opt = true
+	case "off", "false", "0":
+		*opt = false
+	default:
+		return fmt.Errorf("invalid value %q", value[0])
+	}
+	return nil
+}
+
+// template вставляет после адресованной строки (0 - в начало буфера, по умолчанию -
+// в конец) строку текста из хвоста команды, раскрывая в ней %d и %f.
+func (state *State) template(args []string) error {
+	after, err := state.destination(args)
+	if err != nil {
+		return err
+	}
+	var text string
+	if len(args) > 2 {
+		text = args[2]
+	}
+	text = expandTemplate(text, state.filename, time.Now(), state.timeFormat)
+	state.insertLines(after, []string{text})
+	return nil
+}
+
+// expandTemplate заменяет в text %d текущим временем now в формате layout,
+// %f - именем файла filename, %% - символом %.
+func expandTemplate(text, filename string, now time.Time, layout string) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '%' || i+1 == len(text) {
+			sb.WriteByte(text[i])
+			continue
+		}
+		switch text[i+1] {
+		case 'd':
+			sb.WriteString(now.Format(layout))
+		case 'f':
+			sb.WriteString(filename)
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte(text[i])
+			continue
+		}
+		i++
+	}
+	return sb.String()
+}
+
+// setInt устанавливает положительную числовую настройку.
+func setInt(opt *int, value []string) error {
+	if len(value) == 0 {
+		return errors.New("value undefined")
+	}
+	n, err := strconv.Atoi(value[0])
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid value %q", value[0])
+	}
+	*opt = n
+	return nil
+}
+
+// alias управляет псевдонимами команд: A name command определяет псевдоним,
+// A name удаляет его, A без аргументов печатает все псевдонимы. Имя псевдонима -
+// не меньше двух букв и не начинается с буквы встроенной команды, чтобы
+// не перекрывать ее (например, print читалось бы как p с аргументом rint).
+func (state *State) alias(args []string) error {
+	if len(args) < 3 {
+		names := make([]string, 0, len(state.aliases))
+		for name := range state.aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s %s\n", name, state.aliases[name])
+		}
+		return nil
+	}
+	name := args[2]
+	if len(args) == 3 {
+		delete(state.aliases, name)
+		return nil
+	}
+	if len(name) < 2 || strings.IndexFunc(name, func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+		return errors.New("alias name must be two or more letters")
+	}
+	if _, ok := commands[name[0]]; ok {
+		return fmt.Errorf("alias %q would shadow command %c", name, name[0])
+	}
+	if state.aliases == nil {
+		state.aliases = make(map[string]string)
+	}
+	state.aliases[name] = strings.Join(args[3:], " ")
+	return nil
+}
+
+// expandAlias заменяет псевдоним в начале строки команды (первое слово) его текстом,
+// остаток строки дописывается после текста. Псевдонимы раскрываются повторно,
+// циклические определения - ошибка.
+func (state *State) expandAlias(line []byte) ([]byte, error) {
+	seen := make(map[string]bool)
+	for len(state.aliases) > 0 {
+		word, rest, _ := strings.Cut(string(line), " ")
+		text, ok := state.aliases[word]
+		if !ok {
+			break
+		}
+		if seen[word] {
+			return nil, fmt.Errorf("alias loop in %q", word)
+		}
+		seen[word] = true
+		if len(rest) > 0 {
+			text += " " + rest
+		}
+		line = []byte(text)
+	}
+	return line, nil
+}
+
+// lineNumber печатает номера строк, в которые разрешается адрес команды (1,3= печатает 1,3),
+// ничего не меняя. Без адреса печатает номер последней строки.
+func (state *State) lineNumber(args []string) error {
+	top, _ := strconv.Atoi(args[0])
+	last, _ := strconv.Atoi(args[1])
+	if last < 0 || last == top {
+		fmt.Printf("%d\n", top)
+	} else {
+		fmt.Printf("%d,%d\n", top, last)
+	}
+	return nil
+}
+
+// changeCase меняет регистр букв в строках диапазона: ~u - прописные, ~l - строчные,
+// ~t - каждое слово с прописной буквы. С шаблоном (~u/re/) меняются только
+// совпадающие с re части строк. Печатает число измененных строк.
+func (state *State) changeCase(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	tail := strings.Join(args[2:], " ")
+	if len(tail) == 0 {
+		return errors.New("case mode undefined")
+	}
+	var convert func(string) string
+	switch tail[0] {
+	case 'u':
+		convert = strings.ToUpper
+	case 'l':
+		convert = strings.ToLower
+	case 't':
+		convert = titleCase
+	default:
+		return fmt.Errorf("unknown case mode %q", tail[:1])
+	}
+	var re *regexp.Regexp
+	if rest := strings.TrimSpace(tail[1:]); len(rest) > 0 {
+		re, rest, err = state.pattern(rest)
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			return errors.New("unexpected command after pattern")
+		}
+	}
+
+	lines := make([]string, 0, last-top+1)
+	changed := 0
+	for _, line := range state.buffer[top-1 : last] {
+		text := convert(line)
+		if re != nil {
+			text = re.ReplaceAllStringFunc(line, convert)
+		}
+		if text != line {
+			changed++
+		}
+		lines = append(lines, text)
+	}
+	if changed > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", changed)
+	return nil
+}
+
+// titleCase делает первую букву каждого слова прописной, остальные - строчными.
+func titleCase(s string) string {
+	var sb strings.Builder
+	inWord := false
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' {
+			if inWord {
+				r = unicode.ToLower(r)
+			} else {
+				r = unicode.ToTitle(r)
+			}
+			inWord = true
+		} else {
+			inWord = false
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// indentReport печатает с номерами строки диапазона (по умолчанию всего буфера)
+// с несогласованным отступом, ничего не меняя. Строка отмечается, если
+//   - в отступе пробел стоит перед табуляцией;
+//   - отступ сделан не тем символом, что у большинства строк диапазона
+//     (табуляция среди отступов пробелами или наоборот);
+//   - отступ из пробелов не кратен шагу - самой частой разнице отступов
+//     соседних непустых строк.
+//
+// Пустые строки и строки без отступа не проверяются.
+func (state *State) indentReport(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	leads := make([]string, 0, last-top+1)
+	tabs, spaces := 0, 0
+	// steps[d] - сколько раз отступ соседних непустых строк из пробелов отличается на d
+	steps := make(map[int]int)
+	prev := -1
+	for _, line := range state.buffer[top-1 : last] {
+		body := strings.TrimLeft(line, " \t")
+		lead := line[:len(line)-len(body)]
+		if body == "" {
+			leads = append(leads, "")
+			continue
+		}
+		leads = append(leads, lead)
+		switch {
+		case lead == "":
+		case lead[0] == '\t':
+			tabs++
+		default:
+			spaces++
+		}
+		if strings.ContainsRune(lead, '\t') {
+			prev = -1
+			continue
+		}
+		if prev >= 0 && prev != len(lead) {
+			steps[max(prev, len(lead))-min(prev, len(lead))]++
+		}
+		prev = len(lead)
+	}
+	step := 0
+	for d, n := range steps {
+		if step == 0 || n > steps[step] || n == steps[step] && d < step {
+			step = d
+		}
+	}
+
+	flagged := 0
+	for i, lead := range leads {
+		var reason string
+		switch {
+		case lead == "":
+			continue
+		case strings.Contains(lead, " \t"):
+			reason = "space before tab"
+		case lead[0] == '\t' && tabs < spaces:
+			reason = "tab indent, mostly spaces"
+		case lead[0] == ' ' && spaces < tabs:
+			reason = "space indent, mostly tabs"
+		case !strings.ContainsRune(lead, '\t') && step > 0 && len(lead)%step != 0:
+			reason = fmt.Sprintf("indent %d is not a multiple of %d", len(lead), step)
+		default:
+			continue
+		}
+		fmt.Printf("%-4d%s\n", top+i, reason)
+		flagged++
+	}
+	fmt.Printf("%d\n", flagged)
+	return nil
+}
+
+// listItem начало пункта нумерованного списка: отступ, номер, "." или ")"
+var listItem = regexp.MustCompile(`^([ \t]*)([0-9]+)([.)])([ \t]|$)`)
+
+// renumber перенумеровывает пункты нумерованных списков (1. или 1)) в строках
+// диапазона подряд, начиная с base (Q [base], по умолчанию 1), сохраняя
+// знак после номера. Пункты с разным отступом нумеруются отдельно, вложенный
+// список начинается заново после каждого пункта внешнего. Остальные строки не
+// меняются. Печатает число измененных строк.
+func (state *State) renumber(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	base := 1
+	if len(args) > 2 {
+		base, err = strconv.Atoi(args[2])
+		if err != nil || base < 0 {
+			return errors.New("invalid list base")
+		}
+	}
+
+	// next[indent] - следующий номер пункта с отступом indent
+	next := make(map[string]int)
+	lines := make([]string, 0, last-top+1)
+	changed := 0
+	for _, line := range state.buffer[top-1 : last] {
+		m := listItem.FindStringSubmatchIndex(line)
+		if m == nil {
+			lines = append(lines, line)
+			continue
+		}
+		indent := line[m[2]:m[3]]
+		for other := range next {
+			if len(other) > len(indent) {
+				delete(next, other)
+			}
+		}
+		n, ok := next[indent]
+		if !ok {
+			n = base
+		}
+		next[indent] = n + 1
+		text := indent + strconv.Itoa(n) + line[m[6]:]
+		if text != line {
+			changed++
+		}
+		lines = append(lines, text)
+	}
+	if changed > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", changed)
+	return nil
+}
+
+// blankLines удаляет пустые строки диапазона (по умолчанию всего буфера).
+// По умолчанию серия пустых строк подряд заменяется одной, с флагом a
+// удаляются все пустые строки. Пустой считается строка из пробелов
+// и табуляций, с флагом e - только строка без символов. Печатает число
+// удаленных строк.
+func (state *State) blankLines(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	flags := strings.Join(args[2:], "")
+	if strings.Trim(flags, "ae") != "" {
+		return fmt.Errorf("unknown flags %q", flags)
+	}
+	all := strings.ContainsRune(flags, 'a')
+	strict := strings.ContainsRune(flags, 'e')
+	blank := func(line string) bool {
+		if strict {
+			return line == ""
+		}
+		return strings.TrimSpace(line) == ""
+	}
+
+	kept := make([]string, 0, last-top+1)
+	prevBlank := false
+	for _, line := range state.buffer[top-1 : last] {
+		isBlank := blank(line)
+		if isBlank && (all || prevBlank) {
+			continue
+		}
+		prevBlank = isBlank
+		kept = append(kept, line)
+	}
+	removed := last - top + 1 - len(kept)
+	if removed > 0 {
+		state.replaceLines(top, last, kept)
+	}
+	fmt.Printf("%d\n", removed)
+	return nil
+}
+
+// annotate обрабатывает команду t/re/[^][group]: к каждой строке диапазона
+// (по умолчанию всего буфера), совпадающей с re, дописывает через пробел
+// значение группы group (номер или имя (?P<name>...), по умолчанию 1);
+// с ^ значение ставится перед строкой. Остальные строки не меняются.
+// Печатает число измененных строк.
+func (state *State) annotate(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("pattern undefined")
+	}
+	re, rest, err := state.pattern(strings.Join(args[2:], " "))
+	if err != nil {
+		return err
+	}
+	rest = strings.TrimSpace(rest)
+	prepend := strings.HasPrefix(rest, "^")
+	if prepend {
+		rest = rest[1:]
+	}
+	group := 1
+	if len(rest) > 0 {
+		group, err = strconv.Atoi(rest)
+		if err != nil {
+			group = re.SubexpIndex(rest)
+		}
+	}
+	if group < 0 || group > re.NumSubexp() {
+		return fmt.Errorf("no group %q in pattern", rest)
+	}
+
+	lines := make([]string, 0, last-top+1)
+	changed := 0
+	for _, line := range state.buffer[top-1 : last] {
+		m := re.FindStringSubmatchIndex(line)
+		if m == nil || m[2*group] < 0 {
+			lines = append(lines, line)
+			continue
+		}
+		value := line[m[2*group]:m[2*group+1]]
+		if prepend {
+			line = value + " " + line
+		} else {
+			line = line + " " + value
+		}
+		lines = append(lines, line)
+		changed++
+	}
+	if changed > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", changed)
+	return nil
+}
+
+// goTo делает текущей последнюю адресованную строку, ничего не печатая
+// (в отличие от адреса без команды). Без адреса текущая строка не меняется.
+func (state *State) goTo(args []string) error {
+	_, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	state.current = last
+	return nil
+}
+
+// deleteColumns удаляет из строк диапазона символы в колонках с from по to
+// (C from to, нумерация с 1, считаются символы, а не байты). Строки короче
+// from не меняются, to больше длины строки ограничивается ее концом.
+func (state *State) deleteColumns(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 4 {
+		return errors.New("columns undefined")
+	}
+	from, err1 := strconv.Atoi(args[2])
+	to, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || from < 1 || to < from {
+		return errors.New("invalid columns")
+	}
+
+	lines := make([]string, 0, last-top+1)
+	changed := false
+	for _, line := range state.buffer[top-1 : last] {
+		runes := []rune(line)
+		if from <= len(runes) {
+			runes = append(runes[:from-1], runes[min(to, len(runes)):]...)
+			line = string(runes)
+			changed = true
+		}
+		lines = append(lines, line)
+	}
+	if changed {
+		state.replaceLines(top, last, lines)
+	}
+	return nil
+}
+
+// prefixText возвращает префикс из хвоста команды I или K. Форма I\text
+// сохраняет пробелы (I\// ) и раскрывает \t и \\.
+func prefixText(args []string) (string, error) {
+	if len(args) < 3 {
+		return "", errors.New("prefix undefined")
+	}
+	if strings.HasPrefix(args[2], "\\") {
+		return strings.Join(unescapeLines(args[2][1:]), "\n"), nil
+	}
+	return strings.Join(args[2:], " "), nil
+}
+
+// addPrefix добавляет префикс в начало каждой строки диапазона (например,
+// закомментировать блок: I\// ) и печатает число измененных строк.
+func (state *State) addPrefix(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	prefix, err := prefixText(args)
+	if err != nil {
+		return err
+	}
+	if prefix == "" {
+		fmt.Printf("0\n")
+		return nil
+	}
+	lines := make([]string, 0, last-top+1)
+	for _, line := range state.buffer[top-1 : last] {
+		lines = append(lines, prefix+line)
+	}
+	state.replaceLines(top, last, lines)
+	fmt.Printf("%d\n", len(lines))
+	return nil
+}
+
+// removePrefix удаляет префикс из строк диапазона, которые с него начинаются,
+// и печатает число измененных строк.
+func (state *State) removePrefix(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	prefix, err := prefixText(args)
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, last-top+1)
+	changed := 0
+	for _, line := range state.buffer[top-1 : last] {
+		if prefix != "" && strings.HasPrefix(line, prefix) {
+			line = line[len(prefix):]
+			changed++
+		}
+		lines = append(lines, line)
+	}
+	if changed > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", changed)
+	return nil
+}
+
+// new очищает текстовый буфер без сохранения, создает новый документ
+// TODO проверять буфер, предлагать сохранение
+func (state *State) new([]string) error {
+	state.buffer = nil
+	state.current = 0
+	return nil
+}
+
+func (state *State) print(args []string) error {
+	return state.printRange(args, state.lineNumbers)
+}
+
+// printNumbered печатает строки с номерами только для этой команды (#),
+// не меняя флаг отображения номеров строк.
+func (state *State) printNumbered(args []string) error {
+	return state.printRange(args, true)
+}
+
+// printRange печатает строки диапазона, numbered - с номерами строк.
+// Текущей становится последняя напечатанная строка.
+func (state *State) printRange(args []string, numbered bool) error {
+	if len(state.buffer) == 0 {
+		return errEmptyBuffer
+	}
+	// в аргументах гарантированно - цифры, поэтому игнорируем ошибку
+	top, _ := strconv.Atoi(args[0])
+	last, _ := strconv.Atoi(args[1])
+	if top < 0 {
+		return errors.New("invalid address")
+	}
+
+	top--
+	last--
+
+	if top < 0 {
+		top = 0
+	}
+	if last < 0 {
+		last = top + 1
+	} else {
+		last++
+	}
+	if last > len(state.buffer) {
+		last = len(state.buffer)
+	}
+
+	li := top
+	for _, line := range state.buffer[top:last] {
+		if state.interrupted.Load() {
+			state.current = li
+			return errInterrupted
+		}
+		if state.fold {
+			width := state.displayWidth
+			if numbered {
+				width -= 4
+			}
+			line = truncateLine(line, width, state.tabWidth)
+		}
+		if numbered {
+			fmt.Printf("%-4d%s\n", li+1, line)
+		} else {
+			fmt.Printf("%s\n", line)
+		}
+		li++
+	}
+	state.current = last
+	return nil
+}
+
+func (state *State) readFile(args []string) error {
+	// e !command - загрузить в буфер вывод команды оболочки
+	if len(args) > 2 && len(args[2]) > 1 && args[2][0] == '!' {
+		lines, err := state.runShell(args[2][1:])
+		if err != nil {
+			return err
+		}
+		state.buffer = lines
+		state.filename = ""
+		state.changed = false
+		state.partial = false
+		state.crlf = false
+		state.endings = endingCounts{}
+		state.current = len(state.buffer)
+		return nil
+	}
+	// e! file - загрузить файл, даже если он похож на двоичный
+	force := len(args) > 2 && args[2] == "!"
+	if force {
+		args = append(args[:2:2], args[3:]...)
+	}
+	limit, args, err := lineLimit(args)
+	if err != nil {
+		return err
+	}
+	// e без имени файла перечитывает текущий файл с диска; несохраненные
+	// изменения при этом отбрасывает только e!
+	if len(args) < 3 && len(state.filename) > 0 {
+		if state.changed && !force {
+			return errors.New("buffer modified; use e! to discard changes")
+		}
+		args = append(args[:2:2], state.filename)
+	}
+	if len(args) < 3 {
+		return errors.New("File name undefined!")
+	}
+	fn := strings.TrimSpace(args[2])
+
+	var endings endingCounts
+	bb, partial, err := readFile(fn, readOptions{enc: state.encoding, force: force, limit: limit, endings: &endings})
+	if err != nil {
+		return err
+	}
+
+	state.buffer = nil
+	state.buffer = append(state.buffer, bb...)
+	state.filename = fn
+	state.current = len(state.buffer)
+	state.partial = partial
+	state.changed = false
+	state.endings = endings
+	state.crlf = endings.dominantCRLF()
+	// файл без права записи открывается только для чтения
+	state.readOnly = false
+	if info, err := os.Stat(fn); err == nil && info.Mode().Perm()&0200 == 0 {
+		state.readOnly = true
+		fmt.Printf("%s: read-only\n", fn)
+	}
+
+	if staleSwap(fn) {
+		fmt.Printf("%s.swp is newer than %s; use E to recover\n", fn, fn)
+	}
+	return nil
+}
+
+// lineLimit разбирает число строк перед именем файла в командах e и r:
+// +N file - первые N строк, -N file - последние N строк файла
+// (readOptions.limit). Возвращает аргументы без числа строк.
+func lineLimit(args []string) (int, []string, error) {
+	if len(args) < 4 || len(args[2]) < 2 || (args[2][0] != '+' && args[2][0] != '-') {
+		return 0, args, nil
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n == 0 {
+		return 0, nil, errors.New("invalid line count")
+	}
+	return n, append(args[:2:2], args[3:]...), nil
+}
+
+// staleSwap сообщает, остался ли от прерванной записи файл filename.swp,
+// более новый, чем сам файл (или файла нет совсем).
+func staleSwap(filename string) bool {
+	swp, err := os.Stat(filename + ".swp")
+	if err != nil {
+		return false
+	}
+	file, err := os.Stat(filename)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return swp.ModTime().After(file.ModTime())
+}
+
+// recoverSwap предлагает загрузить в буфер оставшийся после сбоя filename.swp,
+// если он новее файла. При согласии буфер считается измененным, имя файла
+// не меняется; при отказе буфер и оба файла остаются как есть.
+func (state *State) recoverSwap([]string) error {
+	if len(state.filename) == 0 {
+		return errors.New("File name undefined!")
+	}
+	if !staleSwap(state.filename) {
+		return errors.New("no swap file to recover")
+	}
+	swp := state.filename + ".swp"
+	fmt.Printf("recover %s from %s? (y/n) ", state.filename, swp)
+	answer, err := state.input()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(answer)) != "y" {
+		return nil
+	}
+	lines, _, err := readFile(swp, readOptions{enc: state.encoding, force: true})
+	if err != nil {
+		return err
+	}
+	state.buffer = lines
+	state.current = len(state.buffer)
+	state.partial = false
+	state.changed = true
+	state.edits++
+	return nil
+}
+
+// read обрабатывает команду r. Форма (addr)r !command выполняет команду оболочки
+// и вставляет ее вывод после адресованной строки, иначе читает файл.
+func (state *State) read(args []string) error {
+	after, err := state.destination(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("File name undefined!")
+	}
+
+	var lines []string
+	if len(args[2]) > 1 && args[2][0] == '!' {
+		lines, err = state.runShell(args[2][1:])
+	} else if args[2] == "-" {
+		lines, err = state.readData()
+	} else {
+		// r! file - читать, даже если файл похож на двоичный
+		force := args[2] == "!"
+		if force {
+			args = append(args[:2:2], args[3:]...)
+		}
+		var limit int
+		limit, args, err = lineLimit(args)
+		if err != nil {
+			return err
+		}
+		if len(args) < 3 {
+			return errors.New("File name undefined!")
+		}
+		fn := strings.TrimSpace(args[2])
+		var partial bool
+		var endings endingCounts
+		lines, partial, err = readFile(fn, readOptions{enc: state.encoding, force: force, limit: limit, endings: &endings})
+		if err == nil && len(state.filename) == 0 {
+			// буфер с частью файла не должен молча перезаписать весь файл
+			state.filename = fn
+			state.partial = partial
+			state.endings = endings
+			state.crlf = endings.dominantCRLF()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	state.insertLines(after, lines)
+	return nil
+}
+
+// readData читает строки данных до конца ввода для r -. Если команды читаются
+// из сценария (-f), данные берутся из стандартного ввода, иначе - из того же
+// ввода, что и команды (на терминале ввод данных завершается Ctrl-D).
+// В журнале и при его повторе данные завершаются строкой ".", а начальная
+// точка строки данных удваивается, чтобы не спутать ее с концом данных.
+func (state *State) readData() ([]string, error) {
+	in := state.data
+	if in == nil {
+		in = state.in
+	}
+	var lines []string
+	for {
+		line, err := readLine(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if state.scripted {
+			if isTerminator(line) {
+				break
+			}
+			line = bytes.TrimPrefix(line, []byte("."))
+		}
+		lines = append(lines, string(line))
+	}
+	if state.journal != nil {
+		for _, line := range lines {
+			if strings.HasPrefix(line, ".") {
+				line = "." + line
+			}
+			state.answers = append(state.answers, []byte(line))
+		}
+		state.answers = append(state.answers, []byte("."))
+	}
+	return lines, nil
+}
+
+// readFiltered обрабатывает команду (addr)R/re/ file: вставляет после адресованной
+// строки (по умолчанию в конец буфера) только строки файла, совпадающие с re,
+// а с флагом R/re/v file - не совпадающие, и печатает число вставленных строк.
+func (state *State) readFiltered(args []string) error {
+	after, err := state.destination(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("pattern undefined")
+	}
+	re, rest, err := state.pattern(args[2])
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(rest)
+	invert := len(fields) == 2 && fields[0] == "v"
+	if invert {
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return errors.New("File name undefined!")
+	}
+
+	lines, err := readMatching(fields[0], readOptions{enc: state.encoding}, re, invert)
+	if err != nil {
+		return err
+	}
+	state.insertLines(after, lines)
+	fmt.Printf("%d\n", len(lines))
+	return nil
+}
+
+// exportJSON записывает строки диапазона (по умолчанию всего буфера) в файл
+// в виде JSON массива строк; имя файла - печатает массив в stdout.
+func (state *State) exportJSON(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("File name undefined!")
+	}
+	var out io.Writer = os.Stdout
+	if args[2] != "-" {
+		file, err := os.Create(args[2])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state.buffer[top-1 : last])
+}
+
+// importJSON вставляет после адресованной строки (0 - в начало буфера,
+// по умолчанию - в конец) строки из файла с JSON массивом строк
+// и печатает число вставленных строк.
+func (state *State) importJSON(args []string) error {
+	after, err := state.destination(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("File name undefined!")
+	}
+	data, err := os.ReadFile(args[2])
+	if err != nil {
+		return err
+	}
+	var lines []string
+	err = json.Unmarshal(data, &lines)
+	if err != nil {
+		return fmt.Errorf("%s: %v", args[2], err)
+	}
+	state.insertLines(after, lines)
+	fmt.Printf("%d\n", len(lines))
+	return nil
+}
+
+// destination возвращает строку, после которой команда вставляет текст:
+// последний адрес команды, 0 - перед первой строкой.
+func (state *State) destination(args []string) (int, error) {
+	top, _ := strconv.Atoi(args[0])
+	last, _ := strconv.Atoi(args[1])
+	if last < 0 {
+		last = top
+	}
+	if last < 0 || last > len(state.buffer) {
+		return 0, errors.New("invalid address")
+	}
+	return last, nil
+}
+
+// lineRange возвращает диапазон строк команды [top, last], нумерация с 1.
+// Одиночный адрес - диапазон из одной строки.
+func (state *State) lineRange(args []string) (int, int, error) {
+	if len(state.buffer) == 0 {
+		return 0, 0, errEmptyBuffer
+	}
+	top, _ := strconv.Atoi(args[0])
+	last, _ := strconv.Atoi(args[1])
+	if last < 0 {
+		last = top
+	}
+	if top < 1 || last > len(state.buffer) || top > last {
+		return 0, 0, errors.New("invalid address")
+	}
+	return top, last, nil
+}
+
+// ForEachLine вызывает fn для каждой строки диапазона addrRange (адреса
+// записываются так же, как перед командой: "1,$", "/re/;+2", пустая строка -
+// весь буфер). fn возвращает новый текст строки и признак ее удаления.
+// Изменения применяются одной заменой после обхода; если fn вернула ошибку,
+// буфер не изменяется.
+func (state *State) ForEachLine(addrRange string, fn func(n int, line string) (string, bool, error)) error {
+	args := []string{"1", strconv.Itoa(len(state.buffer))}
+	if len(addrRange) > 0 {
+		data := []byte(addrRange)
+		if !peekAddr(data) {
+			return errors.New("invalid address")
+		}
+		top, last := state.parseAddresses(&data)
+		if len(data) > 0 {
+			return errors.New("invalid address")
+		}
+		args = []string{strconv.Itoa(top), strconv.Itoa(last)}
+	}
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+
+	lines := make([]string, 0, last-top+1)
+	changed := false
+	for i, line := range state.buffer[top-1 : last] {
+		text, remove, err := fn(top+i, line)
+		if err != nil {
+			return err
+		}
+		if remove {
+			changed = true
+			continue
+		}
+		if text != line {
+			changed = true
+		}
+		lines = append(lines, text)
+	}
+	if changed {
+		state.replaceLines(top, last, lines)
+	}
+	return nil
+}
+
+// replaceLines заменяет строки [top, last] на lines и делает текущей
+// последнюю строку замены (или строку перед диапазоном, если lines пуст).
+func (state *State) replaceLines(top, last int, lines []string) {
+	buffer := make([]string, 0, len(state.buffer)-(last-top+1)+len(lines))
+	buffer = append(buffer, state.buffer[:top-1]...)
+	buffer = append(buffer, lines...)
+	buffer = append(buffer, state.buffer[last:]...)
+	state.buffer = buffer
+	state.changed = true
+	state.edits++
+	state.current = top - 1 + len(lines)
+	if state.current == 0 && len(state.buffer) > 0 {
+		state.current = 1
+	}
+}
+
+// uniq удаляет повторяющиеся подряд строки в диапазоне (по умолчанию во всем буфере).
+// Флаг a удаляет все повторы, а не только соседние, флаг c только печатает
+// число повторов, не изменяя буфер. Флаг l печатает каждую повторяющуюся
+// строку со списком номеров строк, где она встречается, не изменяя буфер.
+func (state *State) uniq(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	var flags string
+	if len(args) > 2 {
+		flags = args[2]
+	}
+	all := strings.ContainsRune(flags, 'a')
+	count := strings.ContainsRune(flags, 'c')
+	if strings.ContainsRune(flags, 'l') {
+		return state.listDuplicates(top, last)
+	}
+	if !count && state.readOnly {
+		return errReadOnly
+	}
+
+	seen := make(map[string]bool)
+	kept := make([]string, 0, last-top+1)
+	meter := state.newProgress(last - top + 1)
+	for i, line := range state.buffer[top-1 : last] {
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		meter.update(i + 1)
+		var dup bool
+		if all {
+			dup = seen[line]
+			seen[line] = true
+		} else {
+			dup = i > 0 && line == state.buffer[top-2+i]
+		}
+		if !dup {
+			kept = append(kept, line)
+		}
+	}
+
+	removed := last - top + 1 - len(kept)
+	if count {
+		fmt.Printf("%d\n", removed)
+		return nil
+	}
+	if removed > 0 {
+		state.replaceLines(top, last, kept)
+	}
+	return nil
+}
+
+// listDuplicates печатает строки диапазона [top, last], встречающиеся в нем
+// больше одного раза, в порядке первого появления: номера строк через запятую
+// и текст строки.
+func (state *State) listDuplicates(top, last int) error {
+	lines := state.buffer[top-1 : last]
+	where := make(map[string][]int)
+	var order []string
+	for i, line := range lines {
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		if _, ok := where[line]; !ok {
+			order = append(order, line)
+		}
+		where[line] = append(where[line], top+i)
+	}
+	for _, line := range order {
+		numbers := where[line]
+		if len(numbers) < 2 {
+			continue
+		}
+		list := make([]string, len(numbers))
+		for i, n := range numbers {
+			list[i] = strconv.Itoa(n)
+		}
+		fmt.Printf("%s: %s\n", strings.Join(list, ","), line)
+	}
+	return nil
+}
+
+// split разбивает каждую строку диапазона на несколько строк по разделителю
+// из хвоста команды (обратная операция к объединению строк).
+// Разделитель вида /re/ задает регулярное выражение. Форма S\delim сохраняет
+// начальные пробелы (S\  - разбить по пробелу) и раскрывает \t и \\.
+func (state *State) split(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("delimiter undefined")
+	}
+	delim := args[2]
+	if strings.HasPrefix(delim, "\\") {
+		delim = strings.Join(unescapeLines(delim[1:]), "\n")
+	}
+	if len(delim) == 0 {
+		return errors.New("delimiter undefined")
+	}
+
+	splitLine := func(line string) []string {
+		return strings.Split(line, delim)
+	}
+	if len(delim) > 1 && delim[0] == '/' && delim[len(delim)-1] == '/' {
+		re, rest, err := state.pattern(delim)
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			return errors.New("unexpected command after pattern")
+		}
+		splitLine = func(line string) []string {
+			return re.Split(line, -1)
+		}
+	}
+
+	lines := make([]string, 0, last-top+1)
+	for _, line := range state.buffer[top-1 : last] {
+		lines = append(lines, splitLine(line)...)
+	}
+	if len(lines) > last-top+1 {
+		state.replaceLines(top, last, lines)
+	}
+	return nil
+}
+
+// alignColumns выравнивает поля строк диапазона в колонки, как column -t.
+// По умолчанию поля разделяются пробелами и в результате разделяются двумя
+// пробелами; J sep разбивает строки по sep и оставляет разделитель после поля.
+// Ширина полей считается в символах, а не в байтах.
+func (state *State) alignColumns(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	sep := strings.Join(args[2:], " ")
+	gap := " "
+	if sep == "" {
+		gap = "  "
+	}
+
+	rows := make([][]string, 0, last-top+1)
+	var widths []int
+	for _, line := range state.buffer[top-1 : last] {
+		var cells []string
+		if sep == "" {
+			cells = strings.Fields(line)
+		} else if strings.TrimSpace(line) != "" {
+			cells = strings.Split(line, sep)
+			for i := range cells {
+				cells[i] = strings.TrimSpace(cells[i])
+				if i < len(cells)-1 {
+					cells[i] += sep
+				}
+			}
+		}
+		for i, cell := range cells {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+		rows = append(rows, cells)
+	}
+
+	lines := make([]string, 0, len(rows))
+	changed := 0
+	for i, cells := range rows {
+		line := state.buffer[top-1+i]
+		if len(cells) > 0 {
+			var sb strings.Builder
+			for j, cell := range cells {
+				sb.WriteString(cell)
+				if j < len(cells)-1 {
+					sb.WriteString(strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell)))
+					sb.WriteString(gap)
+				}
+			}
+			if sb.String() != line {
+				line = sb.String()
+				changed++
+			}
+		}
+		lines = append(lines, line)
+	}
+	if changed > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", changed)
+	return nil
+}
+
+// wrap переносит строки диапазона длиннее заданной ширины (по умолчанию 80 символов)
+// по границам слов. Флаг h режет строки ровно по ширине, не учитывая слова.
+func (state *State) wrap(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	width, hard := 80, false
+	for _, arg := range args[2:] {
+		if arg == "h" {
+			hard = true
+			continue
+		}
+		width, err = strconv.Atoi(arg)
+		if err != nil || width < 1 {
+			return errors.New("invalid wrap width")
+		}
+	}
+
+	lines := make([]string, 0, last-top+1)
+	for _, line := range state.buffer[top-1 : last] {
+		lines = append(lines, wrapLine(line, width, hard, state.tabWidth)...)
+	}
+	if len(lines) > last-top+1 {
+		state.replaceLines(top, last, lines)
+	}
+	return nil
+}
+
+// reflow переформатирует абзацы диапазона, как fmt: строки каждого абзаца
+// объединяются и заново переносятся по границам слов на ширину width
+// (по умолчанию 80 символов). Абзацы разделяются пустыми строками, которые
+// сохраняются; отступ первой строки абзаца сохраняется.
+func (state *State) reflow(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	width := 80
+	if len(args) > 2 {
+		width, err = strconv.Atoi(args[2])
+		if err != nil || width < 1 {
+			return errors.New("invalid wrap width")
+		}
+	}
+
+	var lines, paragraph []string
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		first := paragraph[0]
+		lead := first[:len(first)-len(strings.TrimLeft(first, " \t"))]
+		text := strings.Join(strings.Fields(strings.Join(paragraph, " ")), " ")
+		parts := wrapLine(text, max(width-columns(lead, state.tabWidth), 1), false, state.tabWidth)
+		parts[0] = lead + parts[0]
+		lines = append(lines, parts...)
+		paragraph = paragraph[:0]
+	}
+	for _, line := range state.buffer[top-1 : last] {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			lines = append(lines, line)
+			continue
+		}
+		paragraph = append(paragraph, line)
+	}
+	flush()
+	if !slices.Equal(lines, state.buffer[top-1:last]) {
+		state.replaceLines(top, last, lines)
+	}
+	return nil
+}
+
+// lintLength печатает номера и длины строк диапазона (по умолчанию всего
+// буфера) длиннее width символов (k [width], по умолчанию 80). Длина
+// считается в символах, а не в байтах. С флагом w (k [width] w) такие строки
+// вместо этого переносятся ровно по ширине, как W width h.
+func (state *State) lintLength(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	width, fix := 80, false
+	for _, arg := range args[2:] {
+		if arg == "w" {
+			fix = true
+			continue
+		}
+		width, err = strconv.Atoi(arg)
+		if err != nil || width < 1 {
+			return errors.New("invalid line length")
+		}
+	}
+
+	if fix && state.readOnly {
+		return errReadOnly
+	}
+	lines := make([]string, 0, last-top+1)
+	long := 0
+	for i, line := range state.buffer[top-1 : last] {
+		n := utf8.RuneCountInString(line)
+		if n <= width {
+			lines = append(lines, line)
+			continue
+		}
+		long++
+		if fix {
+			lines = append(lines, wrapLine(line, width, true, state.tabWidth)...)
+			continue
+		}
+		fmt.Printf("%-4d%d\n", top+i, n)
+	}
+	if fix && long > 0 {
+		state.replaceLines(top, last, lines)
+	}
+	if fix {
+		fmt.Printf("%d\n", long)
+	}
+	return nil
+}
+
+// wrapLine разбивает строку на части не шире width позиций экрана (символов,
+// а не байт; табуляция - до следующей позиции, кратной tab). Если hard не
+// установлен, разрыв делается между словами, а слово шире width режется по ширине;
+// отступ строки и пробелы между словами внутри частей не меняются.
+func wrapLine(line string, width int, hard bool, tab int) []string {
+	if columns(line, tab) <= width {
+		return []string{line}
+	}
+	cut := func(s string) []string {
+		var parts []string
+		var chunk []rune
+		col := 0
+		for _, r := range s {
+			next := advance(col, r, tab)
+			if next > width && len(chunk) > 0 {
+				parts = append(parts, string(chunk))
+				chunk = chunk[:0]
+				next = advance(0, r, tab)
+			}
+			chunk = append(chunk, r)
+			col = next
+		}
+		return append(parts, string(chunk))
+	}
+	if hard {
+		return cut(line)
+	}
+
+	// отступ остается в начале первой части, пробелы между словами
+	// сохраняются как есть; пробелы в месте разрыва отбрасываются
+	rest := strings.TrimLeftFunc(line, unicode.IsSpace)
+	cur := line[:len(line)-len(rest)]
+	var parts []string
+	// empty - в текущей части еще нет ни одного слова
+	empty := true
+	for len(rest) > 0 {
+		word := strings.TrimLeftFunc(rest, unicode.IsSpace)
+		sep := rest[:len(rest)-len(word)]
+		end := strings.IndexFunc(word, unicode.IsSpace)
+		if end < 0 {
+			end = len(word)
+		}
+		word, rest = word[:end], word[end:]
+		if len(word) == 0 {
+			break
+		}
+		switch {
+		case empty:
+			cur += word
+		case columns(cur+sep+word, tab) <= width:
+			cur += sep + word
+		default:
+			parts = append(parts, cur)
+			cur = word
+		}
+		empty = false
+		if columns(cur, tab) > width {
+			chunks := cut(cur)
+			parts = append(parts, chunks[:len(chunks)-1]...)
+			cur = chunks[len(chunks)-1]
+		}
+	}
+	return append(parts, cur)
+}
+
+// insertLines вставляет строки после строки after (0 - в начало буфера)
+// и делает текущей последнюю вставленную строку.
+func (state *State) insertLines(after int, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	buffer := make([]string, 0, len(state.buffer)+len(lines))
+	buffer = append(buffer, state.buffer[:after]...)
+	buffer = append(buffer, lines...)
+	buffer = append(buffer, state.buffer[after:]...)
+	state.buffer = buffer
+	state.changed = true
+	state.edits++
+	state.current = after + len(lines)
+}
+
+func (state *State) writeFile(args []string) error {
+	// w! file - записать, даже если буфер содержит только часть файла
+	force := len(args) > 2 && args[2] == "!"
+	if force {
+		args = append(args[:2:2], args[3:]...)
+	}
+	// w +N file - записать буфер частями не больше N байт
+	if len(args) > 2 && len(args[2]) > 1 && args[2][0] == '+' {
+		limit, err := strconv.Atoi(args[2][1:])
+		if err != nil || limit < 1 {
+			return errors.New("invalid chunk size")
+		}
+		if len(args) < 4 {
+			return errors.New("File name undefined!")
+		}
+		return state.writeChunks(args[3], limit)
+	}
+	if len(state.filename) == 0 && len(args) < 3 {
+		return errors.New("File name undefined!")
+	}
+	var fn string
+	if len(args) > 2 {
+		fn = strings.TrimSpace(args[2])
+	} else {
+		fn = state.filename
+	}
+	if state.partial && fn == state.filename && !force {
+		return errors.New("warning: buffer holds only part of the file; use w! to overwrite it")
+	}
+
+	if len(state.buffer) == 0 {
+		// пустой буфер записывается как файл нулевой длины
+		fmt.Printf("writing empty file\n")
+	}
+	err := writeFile(fn, state.buffer, writeOptions{enc: state.encoding, backup: state.backup, crlf: state.crlf})
+	if err != nil {
+		return err
+	}
+	state.changed = false
+	if fn == state.filename {
+		state.partial = false
+	}
+	return nil
+}
+
+// splitWrite обрабатывает команду (addr)V file1 file2: записывает строки
+// 1..addr (по умолчанию до текущей строки) в file1, остальные - в file2
+// и печатает размеры обоих файлов в байтах. Если одна из частей пуста,
+// запись выполняется только в форме V!.
+func (state *State) splitWrite(args []string) error {
+	at, err := state.destination(args)
+	if err != nil {
+		return err
+	}
+	force := len(args) > 2 && args[2] == "!"
+	if force {
+		args = append(args[:2:2], args[3:]...)
+	}
+	// commandTail не разбивает хвост, начинающийся с /, как шаблон, поэтому
+	// абсолютные пути (V /tmp/a /tmp/b) разделяются здесь
+	names := strings.Fields(strings.Join(args[2:], " "))
+	if len(names) != 2 {
+		return errors.New("two file names expected")
+	}
+	if !force && (at == 0 || at == len(state.buffer)) {
+		return errors.New("one of the parts is empty; use V! to write it")
+	}
+
+	opts := writeOptions{enc: state.encoding, backup: state.backup, crlf: state.crlf}
+	parts := [][]string{state.buffer[:at], state.buffer[at:]}
+	sizes := make([]int64, 0, len(parts))
+	for i, fn := range names {
+		err := writeFile(fn, parts[i], opts)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		sizes = append(sizes, info.Size())
+	}
+	fmt.Printf("%d %d\n", sizes[0], sizes[1])
+	return nil
+}
+
+// evalLines выполняет каждую непустую строку диапазона как команду оболочки
+// и вставляет ее вывод сразу после строки. Если команда завершилась с ошибкой,
+// после строки вставляется строка "?" с текстом ошибки. Печатает число
+// выполненных команд.
+func (state *State) evalLines(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, last-top+1)
+	count := 0
+	for _, line := range state.buffer[top-1 : last] {
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		lines = append(lines, line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		output, err := state.runShell(line)
+		if err != nil {
+			output = []string{"? " + err.Error()}
+		}
+		lines = append(lines, output...)
+		count++
+	}
+	if len(lines) > last-top+1 {
+		state.replaceLines(top, last, lines)
+	}
+	fmt.Printf("%d\n", count)
+	return nil
+}
+
+// writeChunks записывает буфер в файлы name.001, name.002 и т.д. размером
+// не больше limit байт каждый, разбивая его только между строками (строка
+// длиннее limit записывается в отдельный файл целиком). Печатает имена
+// и размеры записанных файлов. Части, оставшиеся от прежней записи с большим
+// числом частей (следующие подряд за последней), удаляются, чтобы cat name.*
+// собирал именно этот буфер. Признак изменения буфера не сбрасывается.
+func (state *State) writeChunks(name string, limit int) error {
+	opts := writeOptions{enc: state.encoding, crlf: state.crlf}
+	eol := 1
+	if state.crlf {
+		eol = 2
+	}
+	lineSize := func(line string) int {
+		if state.encoding != nil {
+			line = state.encoding.Encode(line)
+		}
+		return len(line) + eol
+	}
+
+	var chunks [][]string
+	start, size := 0, 0
+	for i, line := range state.buffer {
+		n := lineSize(line)
+		if size > 0 && size+n > limit {
+			chunks = append(chunks, state.buffer[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	chunks = append(chunks, state.buffer[start:])
+
+	for i, chunk := range chunks {
+		fn := fmt.Sprintf("%s.%03d", name, i+1)
+		err := writeFile(fn, chunk, opts)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %d\n", fn, info.Size())
+	}
+	for i := len(chunks) + 1; ; i++ {
+		fn := fmt.Sprintf("%s.%03d", name, i)
+		err := os.Remove(fn)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return fileError("remove", fn, err)
+		}
+		fmt.Printf("%s removed\n", fn)
+	}
+	return nil
+}
+
+// replaceFiles обрабатывает команду x/re/repl/[g] glob: в каждом файле,
+// подходящем под glob, заменяет первое совпадение с re в каждой строке
+// (с флагом g - все совпадения) на repl и записывает измененный файл.
+// В repl & - совпадение целиком, \1-\9 - группы. Буфер не меняется.
+// Для каждого файла печатается число измененных строк; двоичные файлы
+// пропускаются.
+func (state *State) replaceFiles(args []string) error {
+	if len(args) < 3 {
+		return errors.New("pattern undefined")
+	}
+	re, rest, err := state.pattern(strings.Join(args[2:], " "))
+	if err != nil {
+		return err
+	}
+	repl, rest, err := splitPattern("/" + rest)
+	if err != nil {
+		return err
+	}
+	global := strings.HasPrefix(rest, "g")
+	if global {
+		rest = rest[1:]
+	}
+	glob := strings.TrimSpace(rest)
+	if len(glob) == 0 {
+		return errors.New("File name undefined!")
+	}
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s: no matching files", glob)
+	}
+
+	template := replacementTemplate(repl)
+	for _, fn := range files {
+		if state.interrupted.Load() {
+			return errInterrupted
+		}
+		// окончания строк файла (LF, CRLF, нет перевода строки в конце)
+		// сохраняются как есть
+		lines, endings, err := readEndings(fn, readOptions{enc: state.encoding})
+		if errors.Is(err, errBinary) {
+			fmt.Printf("%s: skipped, binary file\n", fn)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		changed := 0
+		for i, line := range lines {
+			text := substitute(re, line, template, global)
+			if text != line {
+				lines[i] = text
+				changed++
+			}
+		}
+		if changed > 0 {
+			err = writeFile(fn, lines, writeOptions{enc: state.encoding, backup: state.backup, endings: endings})
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%s: %d\n", fn, changed)
+	}
+	return nil
+}
+
+// replacementTemplate переводит замену в нотации ed (& - совпадение, \1-\9 -
+// группы, \& - символ &) в шаблон regexp.Expand.
+func replacementTemplate(repl string) string {
+	var sb strings.Builder
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		switch {
+		case c == '$':
+			sb.WriteString("$$")
+		case c == '&':
+			sb.WriteString("${0}")
+		case c == '\\' && i+1 < len(repl) && repl[i+1] >= '0' && repl[i+1] <= '9':
+			sb.WriteString("${" + repl[i+1:i+2] + "}")
+			i++
+		case c == '\\' && i+1 < len(repl):
+			sb.WriteByte(repl[i+1])
+			i++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// substitute заменяет в line первое совпадение с re (global - все совпадения)
+// по шаблону template в нотации regexp.Expand.
+func substitute(re *regexp.Regexp, line, template string, global bool) string {
+	matches := re.FindAllStringSubmatchIndex(line, -1)
+	if len(matches) == 0 {
+		return line
+	}
+	if !global {
+		matches = matches[:1]
+	}
+	var out []byte
+	prev := 0
+	for _, m := range matches {
+		out = append(out, line[prev:m[0]]...)
+		out = re.ExpandString(out, template, line, m)
+		prev = m[1]
+	}
+	return string(append(out, line[prev:]...))
+}
+
+// defaultPager программа просмотра, если переменная PAGER не задана
+const defaultPager = "less"
+
+// page передает строки диапазона (по умолчанию всего буфера) на стандартный
+// ввод программы просмотра $PAGER. Если программу не удалось запустить,
+// строки печатаются, как командой p.
+func (state *State) page(args []string) error {
+	top, last, err := state.lineRange(args)
+	if err != nil {
+		return err
+	}
+	pager := strings.Fields(os.Getenv("PAGER"))
+	if len(pager) == 0 {
+		pager = []string{defaultPager}
+	}
+	text := strings.Join(state.buffer[top-1:last], "\n") + "\n"
+
+	cmd := exec.Command(pager[0], pager[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Print(text)
+		return nil
+	}
+	return cmd.Wait()
+}
+
+// commands таблица команд по их букве. Заполняется в init, так как
+// некоторые команды (G) сами выполняют команды через HandleCommand.
+var commands map[byte]Handler
+
+func init() {
+	commands = map[byte]Handler{
+		'p': (*State).print,             //print buffer
+		'q': (*State).quit,              //quit editor
+		'a': (*State).append,            //append text
+		'r': (*State).read,              //read file or command output
+		'e': (*State).readFile,          //edit file
+		'w': (*State).writeFile,         //write file
+		'l': (*State).numbers,           //on/off line numbers
+		'n': (*State).new,               // новый документ
+		'U': (*State).uniq,              // удалить повторяющиеся строки
+		'S': (*State).split,             // разбить строки по разделителю
+		'W': (*State).wrap,              // перенести длинные строки
+		'f': (*State).status,            // сводка о буфере
+		'b': (*State).switchBuffer,      // переключить буфер
+		'D': (*State).diff,              // отличия от файла на диске
+		'G': (*State).interactiveGlobal, // интерактивная обработка совпадающих строк
+		'd': (*State).delete,            // удалить строки
+		'j': (*State).join,              // объединить строки
+		'N': (*State).normalize,         // нормализовать пробелы
+		'o': (*State).option,            // настройки редактора
+		'T': (*State).template,          // вставить строку с датой или именем файла
+		'F': (*State).grep,              // найти строки по шаблону
+		'X': (*State).purge,             // удалить строки по шаблону
+		'#': (*State).printNumbered,     // печать с номерами строк
+		'A': (*State).alias,             // псевдонимы команд
+		'=': (*State).lineNumber,        // номера адресованных строк
+		'C': (*State).deleteColumns,     // удалить колонки
+		'H': (*State).recall,            // история команд
+		'R': (*State).readFiltered,      // вставить строки файла по шаблону
+		'I': (*State).addPrefix,         // добавить префикс строк
+		'K': (*State).removePrefix,      // удалить префикс строк
+		'L': (*State).lineEndings,       // окончания строк
+		'J': (*State).alignColumns,      // выровнять поля в колонки
+		'E': (*State).recoverSwap,       // восстановить из .swp
+		'P': (*State).reflow,            // переформатировать абзацы
+		'O': (*State).exportJSON,        // записать строки в JSON
+		'Y': (*State).importJSON,        // вставить строки из JSON
+		'V': (*State).splitWrite,        // записать буфер в два файла
+		'Z': (*State).evalLines,         // выполнить строки как команды оболочки
+		'M': (*State).goTo,              // перейти к строке без печати
+		'~': (*State).changeCase,        // изменить регистр букв
+		'B': (*State).indentReport,      // проверить отступы
+		'Q': (*State).renumber,          // перенумеровать списки
+		'z': (*State).blankLines,        // удалить пустые строки
+		'x': (*State).replaceFiles,      // заменить текст в файлах по маске
+		'v': (*State).page,              // просмотр в $PAGER
+		'k': (*State).lintLength,        // найти длинные строки
+		't': (*State).annotate,          // дописать к строкам группу шаблона
+		'&': (*State).repeat,            // повторить последнюю команду
+	}
+}
+
+// parseAddresses разбирает диапазон адресов в начале line и сдвигает line за его
+// пределы. Для одиночного адреса last < 0.
+func (state *State) parseAddresses(line *[]byte) (int, int) {
+	top, ok := state.matchHere(line)
+	last := -1
+	if len(*line) > 0 && ((*line)[0] == ',' || (*line)[0] == ';') {
+		sep := (*line)[0]
+		*line = (*line)[1:]
+		if !ok {
+			// пустой первый адрес: ',' - с первой строки, ';' - с текущей
+			top = 1
+			if sep == ';' {
+				top = state.current
+			}
+		}
+		if sep == ';' {
+			// ';' делает первый адрес текущей строкой до вычисления второго
+			state.current = top
+		}
+		if last, ok = state.matchHere(line); !ok {
+			last = len(state.buffer)
+		}
+	}
+	return top, last
+}
+
+func (state *State) parseCommand(line []byte) (*Command, error) {
+	if len(line) == 0 {
+		// пустая команда переходит на следующую строку и печатает ее
+		return state.printLine(state.current + 1)
+	}
+	if peekCommand(line) {
+		return state.newCommand(line, 1, len(state.buffer), false)
+	}
+	if peekAddr(line) {
+		top, last := state.parseAddresses(&line)
+		if len(line) == 0 {
+			// адрес без команды печатает последнюю адресованную строку
+			if last < 0 {
+				last = top
+			}
+			return state.printLine(last)
+		}
+
+		if peekCommand(line) {
+			return state.newCommand(line, top, last, true)
+		}
+	}
+
+	//ret Error
+	return nil, errors.New("command unknown or syntax error")
+}
+
+// Счетчик повторения пишется сразу после буквы команды: d3 удаляет три строки,
+// начиная с адресованной (по умолчанию текущей), p5 печатает пять строк,
+// j3 объединяет три строки. Число перед командой всегда остается адресом (3d
+// удаляет строку 3), поэтому счетчик не путается с адресом.
+
+// counted команды, принимающие счетчик повторения
+var counted map[byte]bool = map[byte]bool{'p': true, 'd': true, 'j': true}
+
+// currentDefaults команды, которые без адреса действуют не на весь буфер,
+// а на указанное число строк начиная с текущей
+var currentDefaults map[byte]int = map[byte]int{'d': 1, 'j': 2, 'V': 1, 'M': 1}
+
+// newCommand создает команду по букве в начале line с диапазоном адресов [top, last]
+// (last < 0 - одиночный адрес), addressed - адрес указан явно.
+func (state *State) newCommand(line []byte, top, last int, addressed bool) (*Command, error) {
+	//get command's letter
+	cname := line[0]
+	handler, ok := commands[cname]
+	if !ok || handler == nil {
+		return nil, errors.New("Command unknown!")
+	}
+	line = line[1:]
+
+	if addressed {
+		err := state.checkRange(cname, top, last)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cname == '=' && !addressed {
+		// = без адреса, как в ed, печатает номер последней строки
+		top, last = len(state.buffer), -1
+	}
+	// j/re/ без адреса, как F, X и U, действует на весь буфер
+	blocks := cname == 'j' && bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte("/"))
+	if n, ok := currentDefaults[cname]; ok && !addressed && !blocks {
+		top, last = state.current, state.current+n-1
+	}
+	if counted[cname] {
+		count, ok := matchCount(&line)
+		if ok {
+			if count < 1 {
+				return nil, errors.New("invalid count")
+			}
+			start := top
+			if !addressed {
+				start = state.current
+			} else if last >= 0 {
+				start = last
+			}
+			top, last = start, start+count-1
+			if last > len(state.buffer) {
+				return nil, errors.New("invalid address")
+			}
+		}
+	}
+
+	// set up address args
+	args := make([]string, 0)
+	args = append(args, fmt.Sprintf("%d", top))
+	args = append(args, fmt.Sprintf("%d", last))
+	//get tail
+	// TODO pre-calc tail's position!!
+	args = append(args, commandTail(cname, line)...)
+	//ret Command
+	return &Command{name: string(cname), args: args, handler: handler}, nil
+}
+
+// destructive команды, изменяющие строки своего диапазона; в безопасном режиме
+// (o safe) для диапазона больше safeLines строк они требуют подтверждения
+var destructive map[byte]bool = map[byte]bool{'d': true, 'j': true, 'S': true, 'W': true, 'N': true, 'U': true, 'X': true, 'C': true, 'K': true, 'J': true, 'P': true, '~': true, 'z': true}
+
+// confirmRange запрашивает подтверждение, если диапазон команды больше state.safeLines строк.
+func (state *State) confirmRange(args []string) error {
+	top, _ := strconv.Atoi(args[0])
+	last, _ := strconv.Atoi(args[1])
+	if last < 0 {
+		last = top
+	}
+	count := last - top + 1
+	if count <= state.safeLines {
+		return nil
+	}
+	fmt.Printf("%d lines will be affected, continue? (y/n) ", count)
+	answer, err := state.input()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(answer)) != "y" {
+		return errors.New("cancelled")
+	}
+	return nil
+}
+
+// zeroAddress команды, для которых адрес 0 ("перед первой строкой") допустим:
+// он задает место вставки текста. Для остальных команд 0 - недопустимый
+// конец диапазона.
+var zeroAddress map[byte]bool = map[byte]bool{'a': true, 'r': true, 'R': true, 'Y': true, 'T': true, 'V': true, '=': true}
+
+// checkRange проверяет явно указанный диапазон [top, last] (last < 0 - одиночный адрес)
+// команды cname: адреса не выходят за пределы буфера, 0 допустим только для zeroAddress.
+func (state *State) checkRange(cname byte, top, last int) error {
+	if last < 0 {
+		last = top
+	}
+	if top < 0 || last > len(state.buffer) || top > last {
+		return errors.New("invalid address")
+	}
+	if top == 0 && !zeroAddress[cname] {
+		return errors.New("invalid address")
+	}
+	return nil
+}
+
+// matchCount разбирает счетчик повторения (цифры) в начале data.
+func matchCount(data *[]byte) (int, bool) {
+	p := 0
+	for p < len(*data) && '0' <= (*data)[p] && (*data)[p] <= '9' {
+		p++
+	}
+	if p == 0 {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(string((*data)[:p]))
+	*data = (*data)[p:]
+	return n, true
+}
+
+// rawTail команды, хвост которых - текст, в котором значимы все пробелы,
+// кроме отделяющих его от команды (T hello   world, S , , o prompt > )
+var rawTail map[byte]bool = map[byte]bool{'T': true, 'S': true, 'o': true}
+
+// commandTail разбивает хвост команды на аргументы. Символ ! сразу после буквы
+// команды (e!, r!) выделяется в отдельный аргумент "!" - признак принудительного
+// выполнения, в отличие от "r !cmd", где ! начинает аргумент.
+// Хвост, начинающийся с /, - регулярное выражение, возможно с продолжением
+// (G/re/, S /re/), и передается одним аргументом без разбиения по пробелам.
+// Так же передается хвост !command (r !cmd, e !cmd): кавычки и пробелы в нем
+// разбирает оболочка, и хвост команд rawTail.
+func commandTail(cname byte, tail []byte) []string {
+	var args []string
+	if len(tail) > 0 && tail[0] == '!' {
+		args = append(args, "!")
+		tail = tail[1:]
+	}
+	// a\text - текст вставки передается как есть, включая пробелы
+	if len(tail) > 0 && tail[0] == '\\' {
+		return append(args, string(tail))
+	}
+	rest := strings.TrimLeft(string(tail), " \t")
+	if strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "!") {
+		return append(args, rest)
+	}
+	if rawTail[cname] && len(rest) > 0 {
+		return append(args, rest)
+	}
+	return append(args, strings.Fields(rest)...)
+}
+
+// printLine возвращает команду печати одной строки n, проверяя адрес.
+func (state *State) printLine(n int) (*Command, error) {
+	if n < 1 || n > len(state.buffer) {
+		return nil, errors.New("invalid address")
+	}
+	args := []string{fmt.Sprintf("%d", n), fmt.Sprintf("%d", n)}
+	return &Command{name: "p", args: args, handler: commands['p']}, nil
+}
+
+// func (state *State) parseCommand(line []byte) (*Command, error) {
+
+// 	data := line
+
+// 	if len(data) > 1 { //remove prefix .
+// 		data = data[1:]
+// 	}
+// 	cname := data[0]
+// 	handler, ok := commands[cname]
+// 	if !ok || handler == nil {
+// 		return nil, errors.New("Command unknown!")
+// 	}
+// 	tail := strings.TrimSpace(string(data[1:]))
+// 	args := strings.Fields(tail)
+// 	cmd := Command{name: string(cname), args: args, handler: handler}
+// 	return &cmd, nil
+// }
+
+func (state *State) HandleCommand(line []byte) error {
+	line, err := state.expandAlias(line)
+	if err != nil {
+		return err
+	}
+	// переход дальше соседней строки запоминается для адреса '';
+	// смена буфера переходом не считается
+	before, buffer := state.current, state.bufferName
+	defer func() {
+		if state.bufferName != buffer {
+			return
+		}
+		if state.current-before > 1 || before-state.current > 1 {
+			state.prevLine = before
+		}
+	}()
+	cmd, err := state.parseCommand(line)
+	if err != nil {
+		return err
+	}
+	// буфер только для чтения проверяется раньше подтверждения: спрашивать
+	// о команде, которая все равно не выполнится, незачем. Команды, которые
+	// проверяют это сами (U), в этом режиме тоже ничего не меняют.
+	if state.readOnly && modifying[cmd.name[0]] {
+		return errReadOnly
+	}
+	if state.safe && !state.readOnly && destructive[cmd.name[0]] {
+		err = state.confirmRange(cmd.args)
+		if err != nil {
+			return err
+		}
+	}
+	if state.quietEmpty && len(state.buffer) == 0 && printCommands[cmd.name[0]] {
+		return nil
+	}
+	// вложенная команда (из G, H, &) не сбрасывает флаги внешней команды
+	running := state.running.Swap(true)
+	defer state.running.Store(running)
+	if !running {
+		state.interrupted.Store(false)
+	}
+	edits := state.edits
+	err = cmd.handler(state, cmd.args)
+	if err == nil && state.edits != edits {
+		state.printCurrent()
+	}
+	if err == nil && cmd.name != "H" && cmd.name != "&" {
+		state.remember(string(line))
+	}
+	return err
+}
+
+// printCurrent печатает текущую строку после изменения буфера, если включена
+// настройка autoprint; номера строк и обрезка длинных строк учитываются, как в p.
+func (state *State) printCurrent() {
+	if !state.autoPrint || state.mode != modeCommand || state.current < 1 {
+		return
+	}
+	cmd, err := state.printLine(state.current)
+	if err == nil {
+		cmd.handler(state, cmd.args)
+	}
+}
+
+// historySize сколько последних команд хранится в истории
+const historySize = 100
+
+// remember добавляет команду в историю, вытесняя самую старую при переполнении.
+func (state *State) remember(line string) {
+	if len(state.history) == historySize {
+		copy(state.history, state.history[1:])
+		state.history = state.history[:historySize-1]
+		state.historyBase++
+	}
+	state.history = append(state.history, line)
+}
+
+// recall работает с историей команд: H печатает историю с номерами записей,
+// H N повторяет команду с номером N, H -N - N-ю с конца (H -1 - последнюю).
+func (state *State) recall(args []string) error {
+	if len(args) < 3 {
+		for i, line := range state.history {
+			fmt.Printf("%-4d%s\n", state.historyBase+i+1, line)
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.New("invalid history entry")
+	}
+	i := n - state.historyBase - 1
+	if n < 0 {
+		i = len(state.history) + n
+	}
+	if i < 0 || i >= len(state.history) {
+		return errors.New("no such history entry")
+	}
+	line := state.history[i]
+	fmt.Printf("%s\n", line)
+	return state.HandleCommand([]byte(line))
+}
+
+// repeat повторяет последнюю выполненную команду (&). Адреса команды
+// вычисляются заново, поэтому /re/& или d& продвигаются по буферу.
+func (state *State) repeat([]string) error {
+	if len(state.history) == 0 {
+		return errors.New("no previous command")
+	}
+	return state.HandleCommand([]byte(state.history[len(state.history)-1]))
+}
+
+func main() {
+	encName := flag.String("e", "utf-8", "file encoding: utf-8, latin1, cp1251")
+	backup := flag.Bool("b", false, "keep the previous file contents in file~ on write")
+	journalName := flag.String("j", "", "append executed commands to the journal `file`")
+	rcName := flag.String("x", "", "run startup commands from `file` instead of ~/"+rcFile)
+	replayName := flag.String("replay", "", "replay commands from the journal `file` before reading input")
+	scriptName := flag.String("f", "", "run commands from the script `file` instead of standard input")
+	keepGoing := flag.Bool("k", false, "in script mode, report errors and continue instead of exiting")
+	flag.Parse()
+
+	enc, err := lookupCharmap(*encName)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	state := State{
+		mode:         modeCommand,
+		in:           bufio.NewReader(os.Stdin),
+		lineNumbers:  false,
+		searchWrap:   true,
+		timeFormat:   time.DateTime,
+		displayWidth: 80,
+		tabWidth:     8,
+		safeLines:    100,
+		progress:     true,
+		encoding:     enc,
+		backup:       *backup,
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go state.watchInterrupt(sigs)
+
+	state.runStartup(*rcName)
+	if len(*replayName) > 0 {
+		err := state.runScript(*replayName)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		if state.mode == modeQuit {
+			fmt.Printf("Goodbye!\n")
+			os.Exit(0)
+		}
+	}
+	if len(*journalName) > 0 {
+		journal, err := os.OpenFile(*journalName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		defer journal.Close()
+		state.journal = journal
+	}
+
+	// сценарий из файла или перенаправленный стандартный ввод выполняются
+	// неинтерактивно: первая ошибка завершает работу, если не задан -k
+	script := len(*scriptName) > 0 || !isTerminal(os.Stdin)
+	if len(*scriptName) > 0 {
+		file, err := os.Open(*scriptName)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		defer file.Close()
+		state.in = bufio.NewReader(file)
+		// стандартный ввод свободен от команд и служит вводом данных для r -
+		state.data = bufio.NewReader(os.Stdin)
+	}
+	// терминал отмечает вставку из буфера обмена последовательностями
+	// pasteStart и pasteEnd, пока редактор работает
+	exit := func(code int) {
+		if !script {
+			fmt.Print(bracketedPasteOff)
+		}
+		os.Exit(code)
+	}
+	if !script {
+		fmt.Print(bracketedPasteOn)
+	}
+
+	for n := 1; ; n++ {
+		if !script {
+			fmt.Print(state.promptString())
+		}
+		line, err := readLine(state.in)
+		if err != nil {
+			// конец ввода завершает работу, как команда q
+			fmt.Printf("Goodbye!\n")
+			exit(0)
+		}
+		err = state.processLine(line)
+		if err != nil {
+			if script && !*keepGoing {
+				fmt.Fprintf(os.Stderr, "line %d: %s\n", n, err.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("%s\n", err.Error())
+			continue
+		}
+		switch state.mode {
+		case modeQuit:
+			fmt.Printf("Goodbye!\n")
+			exit(0)
 		}
 	}
-	return nil
 }
 
-func (state *State) readFile(args []string) error {
-	if len(args) == 0 {
-		return errors.New("File name undefined!")
+// processLine обрабатывает строку ввода: в режиме добавления сохраняет ее в буфере,
+// в командном режиме выполняет как команду. Успешно обработанные строки
+// записываются в журнал, если он открыт.
+func (state *State) processLine(line []byte) error {
+	line, pasted := state.trackPaste(line)
+	if state.mode == modeAppend {
+		// вставленная из буфера обмена строка "." - текст, а не конец ввода
+		if isTerminator(line) && !pasted {
+			state.mode = modeCommand
+			state.printCurrent()
+		} else if state.insertAt == len(state.buffer) {
+			state.buffer = append(state.buffer, string(line))
+			state.changed = true
+			state.current = len(state.buffer)
+			state.insertAt++
+		} else {
+			state.insertLines(state.insertAt, []string{string(line)})
+			state.insertAt++
+		}
+		return state.logLine(line)
 	}
-	fn := strings.TrimSpace(args[0])
 
-	bb, err := readFile(fn)
+	// вставка, начатая в командном режиме, - это команды (вместе с текстом
+	// для a и завершающей точкой), а не текст
+	state.pasting = false
+	state.answers = state.answers[:0]
+	err := state.HandleCommand(line)
 	if err != nil {
 		return err
 	}
+	if state.mode == modeQuit {
+		return nil
+	}
+	err = state.logLine(line)
+	for _, answer := range state.answers {
+		if err != nil {
+			break
+		}
+		err = state.logLine(answer)
+	}
+	return err
+}
 
-	state.buffer = nil
-	state.buffer = append(state.buffer, bb...)
-	state.filename = fn
+// Последовательности режима bracketed paste: терминал окружает вставленный
+// текст pasteStart и pasteEnd, если редактор включил режим bracketedPasteOn.
+const (
+	bracketedPasteOn  = "\x1b[?2004h"
+	bracketedPasteOff = "\x1b[?2004l"
+)
 
-	return nil
-}
+var (
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
 
-func (state *State) writeFile(args []string) error {
-	if len(state.filename) == 0 && len(args) == 0 {
-		return errors.New("File name undefined!\n")
+// trackPaste удаляет из строки ввода метки начала и конца вставки и отмечает,
+// идет ли вставка. pasted - содержимое строки вставлено, а не набрано:
+// вставка продолжается к началу строки (или начинается в ней) и не
+// заканчивается в самом ее начале.
+func (state *State) trackPaste(line []byte) ([]byte, bool) {
+	if i := bytes.Index(line, pasteStart); i >= 0 {
+		line = append(line[:i:i], line[i+len(pasteStart):]...)
+		state.pasting = true
 	}
-	var fn string
-	if len(args) > 0 {
-		fn = strings.TrimSpace(args[0])
-	} else {
-		fn = state.filename
+	pasted := state.pasting
+	if i := bytes.Index(line, pasteEnd); i >= 0 {
+		pasted = pasted && i > 0
+		line = append(line[:i:i], line[i+len(pasteEnd):]...)
+		state.pasting = false
 	}
+	return line, pasted
+}
 
-	err := writeFile(fn, state.buffer)
-	if err != nil {
-		return err
+// readLine читает строку ввода целиком, без символов конца строки \n или \r\n.
+// В отличие от bufio.Reader.ReadLine длинная строка не разбивается на части,
+// поэтому ее фрагмент не может быть принят за отдельную строку (например, за ".").
+// Последняя строка без \n возвращается без ошибки, io.EOF - при следующем вызове.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
 	}
-	state.changed = false
-	return nil
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return line, nil
 }
 
-var commands map[byte]Handler = map[byte]Handler{
-	'p': (*State).print,     //print buffer
-	'q': (*State).quit,      //quit editor
-	'a': (*State).append,    //append text
-	'r': (*State).readFile,  //read file
-	'w': (*State).writeFile, //write file
-	'l': (*State).numbers,   //on/off line numbers
-	'.': (*State).dot,
-	'n': (*State).new, // новый документ
+// input читает строку, которую команда запрашивает во время выполнения (команду
+// для строки G, ответ y/n), и откладывает ее для журнала: processLine запишет
+// ее после строки самой команды, а -replay прочитает из журнала вслед за ней.
+func (state *State) input() ([]byte, error) {
+	line, err := readLine(state.in)
+	if err == nil && state.journal != nil {
+		state.answers = append(state.answers, line)
+	}
+	return line, err
 }
 
-func (state *State) parseCommand(line []byte) (*Command, error) {
-	//data := line
-	if len(line) > 1 { //remove prefix .
-		line = line[1:]
-	}
-	if peekDot(line) {
-		//ret Command
-		cname := line[0]
-		handler, _ := commands[cname]
-		return &Command{name: string(cname), args: nil, handler: handler}, nil
-	}
-	if peekLetter(line) {
-		var top, last int = 0, len(state.buffer)
-
-		//get command's letter
-		cname := line[0]
-		handler, ok := commands[cname]
-		if !ok || handler == nil {
-			return nil, errors.New("Command unknown!")
-		}
-		//fix addr
-		args := make([]string, 0)
-		args = append(args, fmt.Sprintf("%d", top))
-		args = append(args, fmt.Sprintf("%d", last))
-		//get tail
-		tail := strings.TrimSpace(string(line[1:]))
-		args = append(args, strings.Fields(tail)...)
-		//ret Command
-		return &Command{name: string(cname), args: args, handler: handler}, nil
+// isTerminator Checks if the input line ends append mode: exactly one '.' with nothing
+// around it. Lines like "..", ". " or ".x" are ordinary text.
+func isTerminator(line []byte) bool {
+	return len(line) == 1 && line[0] == '.'
+}
+
+// logLine дописывает строку ввода в журнал команд.
+func (state *State) logLine(line []byte) error {
+	if state.journal == nil {
+		return nil
 	}
-	if peekAddr(line) {
-		//parse address
-		var top, last int = -1, -1
-		top = state.matchHere(&line)
-		if line[0] == ',' {
-			line = line[1:]
-			last = state.matchHere(&line)
+	_, err := fmt.Fprintf(state.journal, "%s\n", line)
+	return err
+}
 
-		}
+// rcFile файл начальных команд в домашнем каталоге пользователя
+const rcFile = ".edrc"
 
-		if peekLetter(line) {
-			//get command's letter
-			cname := line[0]
-			handler, ok := commands[cname]
-			if !ok || handler == nil {
-				return nil, errors.New("Command unknown!")
-			}
-			// set up address args
-			args := make([]string, 0)
-			args = append(args, fmt.Sprintf("%d", top))
-			args = append(args, fmt.Sprintf("%d", last))
-			//get tail
-			// TODO pre-calc tail's position!!
-			tail := strings.TrimSpace(string(line[1:]))
-			args = append(args, strings.Fields(tail)...)
-			//ret Command
-			return &Command{name: string(cname), args: args, handler: handler}, nil
+// runStartup выполняет начальные команды из файла filename (-x) или, если он не
+// задан, из ~/.edrc при его наличии. Ошибки печатаются и не прерывают запуск.
+func (state *State) runStartup(filename string) {
+	if len(filename) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		filename = filepath.Join(home, rcFile)
+		if _, err := os.Stat(filename); err != nil {
+			return
 		}
 	}
-
-	//ret Error
-	return nil, errors.New("command unknown or syntax error")
+	err := state.runScript(filename)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+	}
+	if state.mode == modeAppend {
+		state.mode = modeCommand
+	}
 }
 
-// func (state *State) parseCommand(line []byte) (*Command, error) {
-
-// 	data := line
-
-// 	if len(data) > 1 { //remove prefix .
-// 		data = data[1:]
-// 	}
-// 	cname := data[0]
-// 	handler, ok := commands[cname]
-// 	if !ok || handler == nil {
-// 		return nil, errors.New("Command unknown!")
-// 	}
-// 	tail := strings.TrimSpace(string(data[1:]))
-// 	args := strings.Fields(tail)
-// 	cmd := Command{name: string(cname), args: args, handler: handler}
-// 	return &cmd, nil
-// }
+// promptString возвращает приглашение для текущего режима редактора.
+func (state *State) promptString() string {
+	if state.mode == modeAppend {
+		return state.inputPrompt
+	}
+	return state.prompt
+}
 
-func (state *State) HandleCommand(line []byte) error {
-	cmd, err := state.parseCommand(line)
+// isTerminal сообщает, подключен ли файл к терминалу, а не к файлу или каналу.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
 	if err != nil {
-		return err
+		return false
 	}
-	return cmd.handler(state, cmd.args)
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
-func main() {
-	state := State{
-		mode:        modeCommand,
-		in:          bufio.NewReader(os.Stdin),
-		lineNumbers: false,
+// runScript выполняет строки файла (журнала команд, файла начальных команд),
+// как если бы они были введены пользователем. Ошибки отдельных команд
+// печатаются с именем файла и номером строки и не прерывают выполнение.
+func (state *State) runScript(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	for {
-		line, _, _ := state.in.ReadLine()
-		if line[0] == '.' {
-			err := state.HandleCommand(line)
-			if err != nil {
-				fmt.Printf("%s\n", err.Error())
-				continue
-			}
-			switch state.mode {
-			case modeQuit:
-				fmt.Printf("Goodbye!\n")
-				os.Exit(0)
-				break
-			}
-			continue
+	// ответы и данные, которые запрашивают команды, тоже читаются из файла
+	in, scripted := state.in, state.scripted
+	defer func() {
+		state.in, state.scripted = in, scripted
+	}()
+	reader := bufio.NewReader(file)
+	state.in, state.scripted = reader, true
+	for n := 1; state.mode != modeQuit; n++ {
+		line, err := readLine(reader)
+		if err == io.EOF {
+			break
 		}
-		if state.mode == modeAppend {
-			state.buffer = append(state.buffer, string(line))
-			state.changed = true
+		if err != nil {
+			return err
+		}
+		err = state.processLine(line)
+		if err != nil {
+			fmt.Printf("%s:%d: %s\n", filename, n, err.Error())
 		}
 	}
+	return nil
 }
 
-// peekDot Checks if the raw command line is the only '.' symbol
-func peekDot(data []byte) bool {
-	r, _ := utf8.DecodeRune(data)
-	if r == utf8.RuneError {
-		return false
+// foldMarker заменяет конец строки, обрезанной при печати
+const foldMarker = "…"
+
+// truncateLine обрезает строку до width позиций экрана (символов, а не байт;
+// табуляция - до следующей позиции, кратной tab), заменяя последний видимый
+// символ обрезанной строки на foldMarker.
+func truncateLine(line string, width int, tab int) string {
+	if columns(line, tab) <= width {
+		return line
+	}
+	var sb strings.Builder
+	col := 0
+	for _, r := range line {
+		col = advance(col, r, tab)
+		if col > width-1 {
+			break
+		}
+		sb.WriteRune(r)
 	}
-	if r == '.' {
+	return sb.String() + foldMarker
+}
+
+// peekCommand Checks if the raw command line starts with a command: a letter, '=', '~',
+// '&' (repeat) or '#' (one-shot numbered print). '#' followed by a digit is a byte offset address instead.
+func peekCommand(data []byte) bool {
+	if len(data) > 0 && (data[0] == '=' || data[0] == '~' || data[0] == '&') {
 		return true
 	}
-	return false
+	if len(data) > 0 && data[0] == '#' {
+		return len(data) == 1 || !unicode.IsDigit(rune(data[1]))
+	}
+	return peekLetter(data)
 }
 
 // peekLetter Checks if the raw command line starts with one of the command's list
@@ -296,10 +3458,10 @@ func peekLetter(data []byte) bool {
 	return unicode.IsLetter(r)
 }
 
-// peekAddr Checks if the raw command line starts with numbers, ^ or $ and sets address or range for the [possible] command.
+// peekAddr Checks if the raw command line starts with numbers, ^, $, ., #offset, /re/, ?re?, +/- or a range separator and sets address or range for the [possible] command.
 func peekAddr(data []byte) bool {
 	r, _ := utf8.DecodeRune(data)
-	if '^' == r || ',' == r || unicode.IsDigit(r) {
+	if '^' == r || '$' == r || '.' == r || '#' == r || '\'' == r || '/' == r || '?' == r || ',' == r || ';' == r || '+' == r || '-' == r || unicode.IsDigit(r) {
 		return true
 	}
 	return false
@@ -312,105 +3474,511 @@ func peekAddr(data []byte) bool {
 // ^,$p		^,$p
 // ^+1,$p		^+0*,$p
 // ^,$-1p		^,$-0*p
+// 1;+3p		0*;+0*p
 
 // 0*
+// .
 // ^+0*
 // $-0*
+// +0*, -0* относительно текущей строки
+// +, ++, -, --- знак без числа - смещение на 1
+// /re/, ?re? следующая/предыдущая строка, совпадающая с re
+// 0*% строка на заданном проценте длины буфера
+// '' строка до последнего перехода
+// #0* строка по смещению в байтах (как в выводе grep -b)
+
+// lineAtOffset возвращает номер строки, содержащей байт со смещением off
+// (с 0) в файле, который записала бы команда w: строки считаются в кодировке
+// буфера вместе с окончанием LF или CRLF. Для смещения за концом буфера
+// возвращает -1.
+func (state *State) lineAtOffset(off int) int {
+	if off < 0 {
+		return -1
+	}
+	eol := 1
+	if state.crlf {
+		eol = 2
+	}
+	start := 0
+	for i, line := range state.buffer {
+		if state.encoding != nil {
+			line = state.encoding.Encode(line)
+		}
+		start += len(line) + eol
+		if off < start {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// percentLine возвращает номер строки на pct процентах длины буфера
+// с округлением, ограниченный первой и последней строкой.
+func (state *State) percentLine(pct int) int {
+	n := len(state.buffer)
+	if n == 0 {
+		return 0
+	}
+	return min(max((n*pct+50)/100, 1), n)
+}
+
+// matchHere разбирает адрес в начале data и сдвигает data за его пределы.
+// Возвращает false, если адрес в начале строки отсутствует.
+func (state *State) matchHere(data *[]byte) (int, bool) {
+	if len(*data) == 0 {
+		return 0, false
+	}
+
+	var nn map[byte]int = map[byte]int{'1': 1, '2': 2, '3': 3, '4': 4, '5': 5, '6': 6, '7': 7, '8': 8, '9': 9, '0': 0}
+	number := func() (int, bool) {
+		var acc int = 0
+		p := 0
+		for p < len(*data) {
+			v, ok := nn[(*data)[p]]
+			if !ok {
+				break
+			}
+			acc = acc*10 + v
+			p++
+		}
+		*data = (*data)[p:]
+		return acc, p > 0
+	}
 
-func (state *State) matchHere(data *[]byte) int {
 	var pos int
+	var found bool
 
 	switch (*data)[0] {
 	case '^':
 		pos = 1
+		found = true
 		*data = (*data)[1:]
 	case '$':
 		pos = len(state.buffer)
+		found = true
+		*data = (*data)[1:]
+	case '.':
+		pos = state.current
+		found = true
 		*data = (*data)[1:]
+	case '\'':
+		// '' - строка, которая была текущей до последнего перехода
+		if len(*data) < 2 || (*data)[1] != '\'' {
+			return 0, false
+		}
+		*data = (*data)[2:]
+		pos, found = state.prevLine, true
+		if pos == 0 {
+			pos = -1
+		}
+	case '#':
+		// #N - строка, содержащая байт со смещением N от начала буфера
+		*data = (*data)[1:]
+		var off int
+		off, found = number()
+		pos = state.lineAtOffset(off)
+	case '/', '?':
+		// /re/ - следующая строка, совпадающая с re, ?re? - предыдущая
+		forward := (*data)[0] == '/'
+		re, rest, err := state.pattern(string(*data))
+		*data = []byte(rest)
+		pos, found = -1, true
+		if err == nil {
+			pos = state.search(re, forward)
+		}
+	case '+', '-':
+		pos = state.current
 	default:
-		pos = 0
+		pos, found = number()
+		// N% - строка на N процентах длины буфера
+		if found && len(*data) > 0 && (*data)[0] == '%' {
+			*data = (*data)[1:]
+			pos = state.percentLine(pos)
+		}
 	}
 
-	var dir int
-	switch (*data)[0] {
-	case '-':
-		dir = -1
-		*data = (*data)[1:]
-	case '+':
-		dir = 1
+	// смещения: +N, -N; знак без числа означает 1, знаки накапливаются (---)
+	for len(*data) > 0 && ((*data)[0] == '+' || (*data)[0] == '-') {
+		var dir int = 1
+		if (*data)[0] == '-' {
+			dir = -1
+		}
 		*data = (*data)[1:]
-	default:
-		dir = 1
+		acc, ok := number()
+		if !ok {
+			acc = 1
+		}
+		pos += dir * acc
+		found = true
 	}
 
-	var nn map[byte]int = map[byte]int{'1': 1, '2': 2, '3': 3, '4': 4, '5': 5, '6': 6, '7': 7, '8': 8, '9': 9, '0': 0}
-	var acc int = 0
-	p := 0
+	return pos, found
+}
 
-	for {
-		v, ok := nn[(*data)[p]]
-		if !ok {
-			break
+// shellErrMax сколько байт stderr команды оболочки включается в сообщение об ошибке
+const shellErrMax = 200
+
+// runShell выполняет команду оболочки через state.shell, если он задан,
+// иначе через runShell.
+func (state *State) runShell(cmdline string) ([]string, error) {
+	if state.shell != nil {
+		return state.shell(cmdline)
+	}
+	return runShell(cmdline)
+}
+
+// runShell выполняет команду оболочки и возвращает ее стандартный вывод построчно.
+// Если команда завершилась с ошибкой, ее stderr (в пределах shellErrMax байт)
+// включается в возвращаемую ошибку, а вывод не возвращается.
+func runShell(cmdline string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", cmdline)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > shellErrMax {
+			msg = strings.ToValidUTF8(msg[:shellErrMax], "") + "..."
 		}
-		acc = acc*10 + v
-		p++
+		if len(msg) > 0 {
+			return nil, fmt.Errorf("!%s: %v: %s", cmdline, err, msg)
+		}
+		return nil, fmt.Errorf("!%s: %v", cmdline, err)
 	}
-	*data = (*data)[p:]
+	text := strings.TrimSuffix(stdout.String(), "\n")
+	if len(text) == 0 {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// gzipMagic первые байты сжатого gzip файла
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// errBinary возвращается при попытке загрузить двоичный файл без e!
+var errBinary = errors.New("binary file; use `e!` to force")
+
+// binarySniffLen сколько байт с начала файла проверяется на двоичное содержимое
+const binarySniffLen = 8000
+
+// isBinary Checks if data contains NUL bytes or (when checkUTF8 is set) invalid UTF-8.
+// An incomplete rune at the very end of data is not counted as invalid.
+func isBinary(data []byte, checkUTF8 bool) bool {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	if !checkUTF8 {
+		return false
+	}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			return len(data) >= utf8.UTFMax || utf8.FullRune(data)
+		}
+		data = data[size:]
+	}
+	return false
+}
+
+// readOptions параметры чтения файла
+type readOptions struct {
+	// кодировка файла, nil - UTF-8
+	enc *Charmap
+	// читать файл, даже если он похож на двоичный
+	force bool
+	// limit > 0 - читать только первые limit строк, limit < 0 - только последние -limit строк
+	limit int
+	// если не nil, readFile подсчитывает в нем окончания прочитанных строк
+	endings *endingCounts
+}
+
+// endingCounts число строк файла, завершенных CRLF и LF, и число одиночных CR
+type endingCounts struct {
+	crlf, lf, cr int
+}
 
-	acc *= dir
-	pos += acc
+// add учитывает строку файла line вместе с ее окончанием.
+func (c *endingCounts) add(line string) {
+	switch {
+	case strings.HasSuffix(line, "\r\n"):
+		c.crlf++
+		line = line[:len(line)-2]
+	case strings.HasSuffix(line, "\n"):
+		c.lf++
+		line = line[:len(line)-1]
+	}
+	c.cr += strings.Count(line, "\r")
+}
 
-	return pos
+// dominantCRLF сообщает, завершается ли CRLF больше строк, чем LF.
+func (c endingCounts) dominantCRLF() bool {
+	return c.crlf > c.lf
 }
 
-func readFile(filename string) ([]string, error) {
+// openReader открывает файл для построчного чтения: распаковывает gzip
+// и, если не задан opts.force, отказывается читать двоичный файл.
+// Возвращенная функция закрывает файл.
+func openReader(filename string, opts readOptions) (*bufio.Reader, func(), error) {
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		return nil, nil, fileError("read", filename, syscall.EISDIR)
+	}
 	file, err := os.OpenFile(filename, os.O_RDONLY, 0666)
 	if err != nil {
-		return nil, err
+		return nil, nil, fileError("read", filename, err)
 	}
-	defer file.Close()
+	closeFile := func() { file.Close() }
 
 	reader := bufio.NewReader(file)
+	// сжатый файл распознается по расширению .gz или по сигнатуре gzip
+	magic, _ := reader.Peek(len(gzipMagic))
+	if strings.HasSuffix(filename, ".gz") || bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, fileError("read", filename, err)
+		}
+		closeFile = func() {
+			zr.Close()
+			file.Close()
+		}
+		reader = bufio.NewReader(zr)
+	}
+
+	if !opts.force {
+		head, _ := reader.Peek(binarySniffLen)
+		if isBinary(head, opts.enc == nil) {
+			closeFile()
+			return nil, nil, errBinary
+		}
+	}
+	return reader, closeFile, nil
+}
+
+// readMatching читает из файла только строки, совпадающие с re (при invert -
+// не совпадающие). Файл просматривается потоком, в памяти хранятся только
+// отобранные строки.
+func readMatching(filename string, opts readOptions, re *regexp.Regexp, invert bool) ([]string, error) {
+	reader, closeFile, err := openReader(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile()
+
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimSuffix(line, "\n")
+			line = strings.TrimSuffix(line, "\r")
+			if opts.enc != nil {
+				line = opts.enc.Decode(line)
+			}
+			if re.MatchString(line) != invert {
+				lines = append(lines, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fileError("read", filename, err)
+		}
+	}
+	return lines, nil
+}
+
+// readFile читает файл построчно. Второе возвращаемое значение true,
+// если из-за opts.limit прочитана только часть файла.
+func readFile(filename string, opts readOptions) ([]string, bool, error) {
+	reader, closeFile, err := openReader(filename, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer closeFile()
+
 	var buffer []string
+	var partial bool
+	// для чтения хвоста файла buffer работает как кольцевой, next - самая старая строка
+	next := 0
 	for {
 		line, err := reader.ReadString('\n')
 		if len(line) > 0 {
-			line = strings.TrimSpace(line)
-			buffer = append(buffer, line)
+			if opts.limit > 0 && len(buffer) == opts.limit {
+				partial = true
+				break
+			}
+			if opts.endings != nil {
+				opts.endings.add(line)
+			}
+			// отрезается только конец строки, отступы и пробелы сохраняются
+			line = strings.TrimSuffix(line, "\n")
+			line = strings.TrimSuffix(line, "\r")
+			if opts.enc != nil {
+				line = opts.enc.Decode(line)
+			}
+			if opts.limit < 0 && len(buffer) == -opts.limit {
+				buffer[next] = line
+				next = (next + 1) % len(buffer)
+				partial = true
+			} else {
+				buffer = append(buffer, line)
+			}
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, false, fileError("read", filename, err)
 		}
 	}
-	return buffer, nil
+	if next > 0 {
+		buffer = append(buffer[next:], buffer[:next]...)
+	}
+	return buffer, partial, nil
 }
 
-func writeFile(filename string, buffer []string) error {
-	file, err := os.Create(filename + ".swp")
+// readEndings читает строки файла, как readFile, и возвращает вместе с ними
+// их окончания: "\n", "\r\n" или "" у последней строки без перевода строки.
+func readEndings(filename string, opts readOptions) ([]string, []string, error) {
+	reader, closeFile, err := openReader(filename, opts)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	defer closeFile()
 
-	writer := bufio.NewWriter(file)
-	for _, line := range buffer {
-		_, err := writer.WriteString(line + "\n")
+	var lines, endings []string
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			text := strings.TrimSuffix(line, "\n")
+			text = strings.TrimSuffix(text, "\r")
+			endings = append(endings, line[len(text):])
+			if opts.enc != nil {
+				text = opts.enc.Decode(text)
+			}
+			lines = append(lines, text)
+		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			file.Close()
-			return err
+			return nil, nil, fileError("read", filename, err)
 		}
 	}
-	err = writer.Flush()
+	return lines, endings, nil
+}
+
+// writeOptions параметры записи файла
+type writeOptions struct {
+	// кодировка файла, nil - UTF-8
+	enc *Charmap
+	// сохранить прежнее содержимое файла в filename~
+	backup bool
+	// завершать строки CRLF вместо LF
+	crlf bool
+	// окончания строк буфера по отдельности (например, прочитанные readEndings);
+	// nil - все строки завершаются LF или CRLF
+	endings []string
+}
+
+// writeFile записывает буфер во временный файл filename.swp и затем
+// переименовывает его в filename, так что прежний файл заменяется целиком.
+func writeFile(filename string, buffer []string, opts writeOptions) error {
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		return fileError("write", filename, syscall.EISDIR)
+	}
+	swp := filename + ".swp"
+	file, err := os.Create(swp)
 	if err != nil {
+		// например, каталог файла недоступен для записи
+		return fileError("create temporary file", swp, err)
+	}
+	// при любой неудаче после создания временный файл удаляется
+	fail := func(op, path string, err error) error {
 		file.Close()
-		return err
+		os.Remove(swp)
+		return fileError(op, path, err)
+	}
+
+	// файл с расширением .gz сжимается при записи
+	var out io.Writer = file
+	var zw *gzip.Writer
+	if strings.HasSuffix(filename, ".gz") {
+		zw = gzip.NewWriter(file)
+		out = zw
 	}
-	file.Close()
 
-	os.Remove(filename)
-	os.Rename(filename+".swp", filename)
+	eol := "\n"
+	if opts.crlf {
+		eol = "\r\n"
+	}
+	// строка и ее окончание пишутся по отдельности, без склейки в новую строку
+	writer := bufio.NewWriter(out)
+	for i, line := range buffer {
+		if opts.enc != nil {
+			line = opts.enc.Encode(line)
+		}
+		end := eol
+		if opts.endings != nil {
+			end = opts.endings[i]
+		}
+		_, err := writer.WriteString(line)
+		if err == nil {
+			_, err = writer.WriteString(end)
+		}
+		if err != nil {
+			return fail("write", swp, err)
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return fail("write", swp, err)
+	}
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return fail("write", swp, err)
+		}
+	}
+	err = file.Close()
+	if err != nil {
+		return fail("write", swp, err)
+	}
 
+	// резервная копия: сначала прежний файл переименовывается в filename~,
+	// при неудаче следующего шага он возвращается на место
+	backup := opts.backup
+	if backup {
+		err = os.Rename(filename, filename+"~")
+		if os.IsNotExist(err) {
+			backup = false
+		} else if err != nil {
+			return fail("back up", filename, err)
+		}
+	}
+	err = os.Rename(swp, filename)
+	if err != nil {
+		if backup {
+			os.Rename(filename+"~", filename)
+		}
+		return fail("replace", filename, err)
+	}
 	return nil
 }
+
+// fileError описывает ошибку файловой операции op над path: "cannot read
+// file: permission denied" вместо сообщения системного вызова. Исходная
+// причина (fs.ErrPermission, fs.ErrNotExist, syscall.EISDIR) доступна через
+// errors.Is.
+func fileError(op, path string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		err = linkErr.Err
+	}
+	return fmt.Errorf("cannot %s %s: %w", op, path, err)
+}
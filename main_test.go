@@ -0,0 +1,2829 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// newTestState создает редактор в командном режиме с буфером lines;
+// текущая строка - последняя.
+func newTestState(lines ...string) *State {
+	return &State{
+		mode:         modeCommand,
+		buffer:       lines,
+		current:      len(lines),
+		searchWrap:   true,
+		displayWidth: 80,
+		tabWidth:     8,
+		safeLines:    100,
+	}
+}
+
+// captureOutput выполняет fn и возвращает все, что она напечатала в стандартный вывод.
+func captureOutput(t testing.TB, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stdout, fn)
+}
+
+// captureStderr выполняет fn и возвращает все, что она напечатала в stderr.
+func captureStderr(t testing.TB, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stderr, fn)
+}
+
+// captureFile подменяет на время fn файл *file временным и возвращает
+// записанное в него.
+func captureFile(t testing.TB, file **os.File, fn func()) string {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	saved := *file
+	*file = out
+	defer func() {
+		*file = saved
+	}()
+	fn()
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// runCommands выполняет строки ввода, как если бы их ввел пользователь,
+// и возвращает напечатанное ими. Ошибка любой строки завершает тест.
+func runCommands(t testing.TB, state *State, lines ...string) string {
+	t.Helper()
+	return captureOutput(t, func() {
+		for _, line := range lines {
+			if err := state.processLine([]byte(line)); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+		}
+	})
+}
+
+// TestMain позволяет тестам запускать редактор целиком: тестовая программа,
+// запущенная с переменной окружения ED_TEST_MAIN=1, работает как ed
+// с переданными ей аргументами (см. runEditor).
+func TestMain(m *testing.M) {
+	if os.Getenv("ED_TEST_MAIN") == "1" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// runEditor запускает редактор с аргументами args в каталоге dir, передавая
+// ему stdin, и возвращает его стандартный вывод, поток ошибок и код завершения.
+func runEditor(t *testing.T, dir, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "ED_TEST_MAIN=1", "HOME="+dir)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestMatchHere(t *testing.T) {
+	tests := []struct {
+		addr  string
+		pos   int
+		found bool
+		rest  string
+	}{
+		{"3p", 3, true, "p"},
+		{".", 5, true, ""},
+		{"$", 10, true, ""},
+		{"+", 6, true, ""},
+		{"++", 7, true, ""},
+		{"-", 4, true, ""},
+		{"---", 2, true, ""},
+		{"+2", 7, true, ""},
+		{".-2p", 3, true, "p"},
+		{"$-", 9, true, ""},
+		{"/g/", 7, true, ""},
+		{"?b?p", 2, true, "p"},
+		{"50%", 5, true, ""},
+		{"p", 0, false, "p"},
+		{"", 0, false, ""},
+	}
+	for _, tt := range tests {
+		state := newTestState(strings.Split("a b c d e f g h i j", " ")...)
+		state.current = 5
+		data := []byte(tt.addr)
+		pos, found := state.matchHere(&data)
+		if pos != tt.pos || found != tt.found || string(data) != tt.rest {
+			t.Errorf("matchHere(%q) = %d, %t, rest %q; want %d, %t, rest %q",
+				tt.addr, pos, found, data, tt.pos, tt.found, tt.rest)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line      string
+		name      string
+		top, last int
+		// текущая строка после разбора адресов (';' переносит ее на первый адрес)
+		current int
+		fail    bool
+	}{
+		// ; - от первого адреса, который становится текущей строкой
+		{line: "1;+3p", name: "p", top: 1, last: 4, current: 1},
+		{line: "/e/;/g/p", name: "p", top: 5, last: 7, current: 5},
+		{line: "/c/;+2p", name: "p", top: 3, last: 5, current: 3},
+		{line: ";p", name: "p", top: 2, last: 10, current: 2},
+		{line: "1,3p", name: "p", top: 1, last: 3, current: 2},
+		{line: ",p", name: "p", top: 1, last: 10, current: 2},
+		// относительные адреса без числа
+		{line: "+p", name: "p", top: 3, last: -1, current: 2},
+		{line: "++p", name: "p", top: 4, last: -1, current: 2},
+		{line: "-p", name: "p", top: 1, last: -1, current: 2},
+		{line: "---p", fail: true},
+		// пустая команда и адрес без команды печатают строку
+		{line: "", name: "p", top: 3, last: 3, current: 2},
+		{line: "4", name: "p", top: 4, last: 4, current: 2},
+		// команда без точки в начале
+		{line: "p", name: "p", top: 1, last: 10, current: 2},
+		{line: "d", name: "d", top: 2, last: 2, current: 2},
+		{line: "d3", name: "d", top: 2, last: 4, current: 2},
+		// 0 - место вставки, но не конец диапазона
+		{line: "0a", name: "a", top: 0, last: -1, current: 2},
+		{line: "0r", name: "r", top: 0, last: -1, current: 2},
+		{line: "0T", name: "T", top: 0, last: -1, current: 2},
+		{line: "0p", fail: true},
+		{line: "0d", fail: true},
+		{line: "0,3p", fail: true},
+		{line: "11p", fail: true},
+		{line: "3,2p", fail: true},
+		{line: "?", fail: true},
+	}
+	for _, tt := range tests {
+		state := newTestState(strings.Split("a b c d e f g h i j", " ")...)
+		state.current = 2
+		cmd, err := state.parseCommand([]byte(tt.line))
+		if tt.fail {
+			if err == nil {
+				t.Errorf("parseCommand(%q) = %s %v, want error", tt.line, cmd.name, cmd.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%q): %v", tt.line, err)
+			continue
+		}
+		top, _ := strconv.Atoi(cmd.args[0])
+		last, _ := strconv.Atoi(cmd.args[1])
+		if cmd.name != tt.name || top != tt.top || last != tt.last || state.current != tt.current {
+			t.Errorf("parseCommand(%q) = %s %d,%d (current %d), want %s %d,%d (current %d)",
+				tt.line, cmd.name, top, last, state.current, tt.name, tt.top, tt.last, tt.current)
+		}
+	}
+}
+
+func TestAppendTerminator(t *testing.T) {
+	state := newTestState("first")
+	input := []string{"a", "..", ". ", ".x", " .", "."}
+	for _, line := range input {
+		if err := state.processLine([]byte(line)); err != nil {
+			t.Fatalf("processLine(%q): %v", line, err)
+		}
+	}
+	want := []string{"first", "..", ". ", ".x", " ."}
+	if !slices.Equal(state.buffer, want) {
+		t.Errorf("buffer = %q, want %q", state.buffer, want)
+	}
+	if state.mode != modeCommand {
+		t.Errorf("mode = %d after \".\", want command mode", state.mode)
+	}
+}
+
+func TestCommandTail(t *testing.T) {
+	tests := []struct {
+		cname byte
+		tail  string
+		want  []string
+	}{
+		{'w', " a.txt", []string{"a.txt"}},
+		{'e', "! f.bin", []string{"!", "f.bin"}},
+		{'r', ` !printf '%s\n' "a    b"`, []string{`!printf '%s\n' "a    b"`}},
+		{'G', "/re/", []string{"/re/"}},
+		{'a', `\  text`, []string{`\  text`}},
+		{'T', " hello   world ", []string{"hello   world "}},
+		{'S', " , ", []string{", "}},
+		{'o', " prompt > ", []string{"prompt > "}},
+		{'o', "", nil},
+		{'j', " 3 f", []string{"3", "f"}},
+	}
+	for _, tt := range tests {
+		got := commandTail(tt.cname, []byte(tt.tail))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("commandTail(%c, %q) = %q, want %q", tt.cname, tt.tail, got, tt.want)
+		}
+	}
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	lines := []string{"first", "", "  indented", "последняя"}
+	name := filepath.Join(t.TempDir(), "text.gz")
+	if err := writeFile(name, lines, writeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		t.Fatalf("%s is not gzip compressed", name)
+	}
+	got, _, err := readFile(name, readOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, lines) {
+		t.Errorf("readFile() = %q, want %q", got, lines)
+	}
+
+	// сжатый файл без расширения .gz распознается по сигнатуре
+	plain := filepath.Join(t.TempDir(), "text")
+	if err := os.WriteFile(plain, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err = readFile(plain, readOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, lines) {
+		t.Errorf("readFile() without .gz = %q, want %q", got, lines)
+	}
+}
+
+func TestWriteBackup(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "text.txt")
+	if err := os.WriteFile(name, []byte("old 1\nold 2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(name, []string{"new"}, writeOptions{backup: true}); err != nil {
+		t.Fatal(err)
+	}
+	for fn, want := range map[string]string{name: "new\n", name + "~": "old 1\nold 2\n"} {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", fn, data, want)
+		}
+	}
+	if _, err := os.Stat(name + ".swp"); !os.IsNotExist(err) {
+		t.Errorf("%s.swp left after write", name)
+	}
+
+	// первая запись нового файла обходится без резервной копии
+	fresh := filepath.Join(t.TempDir(), "fresh.txt")
+	if err := writeFile(fresh, []string{"x"}, writeOptions{backup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fresh + "~"); !os.IsNotExist(err) {
+		t.Errorf("backup %s~ created for a new file", fresh)
+	}
+}
+
+func TestWriteFailureRemovesSwap(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "text.txt")
+	if err := os.WriteFile(name, []byte("old\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// резервную копию нельзя создать: на месте text.txt~ непустой каталог
+	if err := os.MkdirAll(filepath.Join(name+"~", "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(name, []string{"new"}, writeOptions{backup: true}); err == nil {
+		t.Fatal("writeFile() succeeded, want a backup error")
+	}
+	if _, err := os.Stat(name + ".swp"); !os.IsNotExist(err) {
+		t.Errorf("%s.swp left after a failed write", name)
+	}
+	if data, _ := os.ReadFile(name); string(data) != "old\n" {
+		t.Errorf("%s = %q after a failed write, want the old contents", name, data)
+	}
+
+	// ошибка самой записи: text.txt.swp указывает на переполненное устройство
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	full := filepath.Join(t.TempDir(), "full.txt")
+	if err := os.Symlink("/dev/full", full+".swp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(full, []string{"x"}, writeOptions{}); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("writeFile() to a full device = %v, want ENOSPC", err)
+	}
+	if _, err := os.Lstat(full + ".swp"); !os.IsNotExist(err) {
+		t.Errorf("%s.swp left after a failed write", full)
+	}
+}
+
+func TestRecoverSwap(t *testing.T) {
+	for _, answer := range []string{"y", "n"} {
+		name := filepath.Join(t.TempDir(), "text.txt")
+		if err := os.WriteFile(name, []byte("saved\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		// .swp, оставшийся от прерванной записи, новее файла
+		if err := os.WriteFile(name+".swp", []byte("unsaved 1\nunsaved 2\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		state := newTestState()
+		out := runCommands(t, state, "e "+name)
+		if !strings.Contains(out, name+".swp is newer than "+name+"; use E to recover") {
+			t.Errorf("e printed %q, want a stale swap warning", out)
+		}
+		state.in = bufio.NewReader(strings.NewReader(answer + "\n"))
+		runCommands(t, state, "E")
+
+		want, changed := []string{"saved"}, false
+		if answer == "y" {
+			want, changed = []string{"unsaved 1", "unsaved 2"}, true
+		}
+		if !slices.Equal(state.buffer, want) || state.changed != changed || state.filename != name {
+			t.Errorf("E answered %q: buffer %q, changed %t, filename %q; want %q, %t, %q",
+				answer, state.buffer, state.changed, state.filename, want, changed, name)
+		}
+		// оба файла на диске остаются как есть
+		if data, _ := os.ReadFile(name); string(data) != "saved\n" {
+			t.Errorf("E answered %q: %s = %q", answer, name, data)
+		}
+		if _, err := os.Stat(name + ".swp"); err != nil {
+			t.Errorf("E answered %q: %v", answer, err)
+		}
+	}
+
+	state := newTestState()
+	state.filename = filepath.Join(t.TempDir(), "none.txt")
+	if err := state.HandleCommand([]byte("E")); err == nil || err.Error() != "no swap file to recover" {
+		t.Errorf("E without a swap file = %v, want error", err)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	// каталог вместо файла
+	_, _, err := readFile(dir, readOptions{})
+	if !errors.Is(err, syscall.EISDIR) || !strings.HasPrefix(err.Error(), "cannot read "+dir+":") {
+		t.Errorf("readFile(dir) = %v, want a read error for a directory", err)
+	}
+	err = writeFile(dir, []string{"x"}, writeOptions{})
+	if !errors.Is(err, syscall.EISDIR) || !strings.HasPrefix(err.Error(), "cannot write "+dir+":") {
+		t.Errorf("writeFile(dir) = %v, want a write error for a directory", err)
+	}
+
+	missing := filepath.Join(dir, "missing.txt")
+	_, _, err = readFile(missing, readOptions{})
+	if !errors.Is(err, fs.ErrNotExist) || !strings.HasPrefix(err.Error(), "cannot read "+missing+":") {
+		t.Errorf("readFile(missing) = %v, want a read error for a missing file", err)
+	}
+}
+
+func TestWritePermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not checked for root")
+	}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "text.txt")
+	if err := os.WriteFile(name, []byte("old\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+
+	// временный файл не создается - об этом и сообщается, файл не тронут
+	err := writeFile(name, []string{"new"}, writeOptions{})
+	if !errors.Is(err, fs.ErrPermission) || !strings.HasPrefix(err.Error(), "cannot create temporary file "+name+".swp:") {
+		t.Errorf("writeFile() = %v, want a permission error for the temporary file", err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil || string(data) != "old\n" {
+		t.Errorf("%s = %q, %v after failed write, want \"old\\n\"", name, data, err)
+	}
+}
+
+// discardOutput направляет стандартный вывод в /dev/null до конца теста,
+// чтобы команды, печатающие результат, не засоряли вывод benchmark.
+func discardOutput(tb testing.TB) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = null
+	tb.Cleanup(func() {
+		os.Stdout = stdout
+		null.Close()
+	})
+}
+
+// benchmarkLines строки для benchmark: каждая десятая содержит "error".
+func benchmarkLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = "line " + strconv.Itoa(i) + " ok"
+		if i%10 == 0 {
+			lines[i] = "line " + strconv.Itoa(i) + " error"
+		}
+	}
+	return lines
+}
+
+// BenchmarkPurge сравнивает X/re/ с удалением тех же строк по одной командой d,
+// как это делает g/re/d.
+func BenchmarkPurge(b *testing.B) {
+	discardOutput(b)
+	lines := benchmarkLines(20000)
+	b.Run("X", func(b *testing.B) {
+		for b.Loop() {
+			state := newTestState(slices.Clone(lines)...)
+			if err := state.HandleCommand([]byte("X/error/")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("d", func(b *testing.B) {
+		for b.Loop() {
+			state := newTestState(slices.Clone(lines)...)
+			re := regexp.MustCompile("error")
+			for n := len(state.buffer); n >= 1; n-- {
+				if !re.MatchString(state.buffer[n-1]) {
+					continue
+				}
+				if err := state.HandleCommand([]byte(strconv.Itoa(n) + "d")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestReadLimit(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log.txt")
+	if err := os.WriteFile(name, []byte("1\n2\n3\n4\n5\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		limit   int
+		want    []string
+		partial bool
+	}{
+		{0, []string{"1", "2", "3", "4", "5"}, false},
+		{2, []string{"1", "2"}, true},
+		{-2, []string{"4", "5"}, true},
+		{5, []string{"1", "2", "3", "4", "5"}, false},
+		{-7, []string{"1", "2", "3", "4", "5"}, false},
+	}
+	for _, tt := range tests {
+		got, partial, err := readFile(name, readOptions{limit: tt.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) || partial != tt.partial {
+			t.Errorf("readFile(limit %d) = %q, partial %t; want %q, partial %t", tt.limit, got, partial, tt.want, tt.partial)
+		}
+	}
+}
+
+// BenchmarkReadLimit читает первые и последние 100 строк файла
+// в миллион строк и файл целиком.
+func BenchmarkReadLimit(b *testing.B) {
+	name := filepath.Join(b.TempDir(), "big.log")
+	if err := os.WriteFile(name, []byte(strings.Join(benchmarkLines(1000000), "\n")+"\n"), 0666); err != nil {
+		b.Fatal(err)
+	}
+	for _, limit := range []int{0, 100, -100} {
+		b.Run(strconv.Itoa(limit), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, _, err := readFile(name, readOptions{limit: limit}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPatternCache(t *testing.T) {
+	var cache patternCache
+	a, err := cache.compile("a+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := cache.compile("b+")
+	if a == b || a.String() != "a+" || b.String() != "b+" {
+		t.Fatalf("compile() = %v, %v for different patterns", a, b)
+	}
+	if again, _ := cache.compile("a+"); again != a {
+		t.Error("compile() recompiled a cached pattern")
+	}
+	if _, err := cache.compile("("); err == nil {
+		t.Error("compile(\"(\") succeeded, want error")
+	}
+
+	// при переполнении вытесняется шаблон, который дольше всех не использовался
+	for i := range patternCacheSize - 1 {
+		cache.compile("p" + strconv.Itoa(i))
+	}
+	cache.compile("a+")
+	cache.compile("overflow")
+	if cache.order.Len() != patternCacheSize {
+		t.Errorf("cache holds %d patterns, want %d", cache.order.Len(), patternCacheSize)
+	}
+	if _, ok := cache.entries["b+"]; ok {
+		t.Error("least recently used pattern b+ was not evicted")
+	}
+	if again, _ := cache.compile("a+"); again != a {
+		t.Error("recently used pattern a+ was evicted")
+	}
+}
+
+// BenchmarkPatternSearch ищет одну и ту же строку тысячу раз, как сценарий
+// из одинаковых адресов /re/, с кешем шаблонов и с компиляцией каждый раз.
+func BenchmarkPatternSearch(b *testing.B) {
+	lines := benchmarkLines(1000)
+	const pattern = `/line 99[0-9] (error|warning)$/`
+	b.Run("cached", func(b *testing.B) {
+		state := newTestState(lines...)
+		for b.Loop() {
+			for range 1000 {
+				re, _, err := state.pattern(pattern)
+				if err != nil {
+					b.Fatal(err)
+				}
+				state.current = 985
+				state.search(re, true)
+			}
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		state := newTestState(lines...)
+		for b.Loop() {
+			for range 1000 {
+				src, _, err := splitPattern(pattern)
+				if err != nil {
+					b.Fatal(err)
+				}
+				re := regexp.MustCompile(src)
+				state.current = 985
+				state.search(re, true)
+			}
+		}
+	})
+}
+
+func TestWriteFileAllocs(t *testing.T) {
+	dir := t.TempDir()
+	allocs := func(n int, opts writeOptions) float64 {
+		lines := benchmarkLines(n)
+		name := filepath.Join(dir, "out.txt")
+		return testing.AllocsPerRun(5, func() {
+			if err := writeFile(name, lines, opts); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// число выделений памяти не зависит от числа строк: строки не склеиваются
+	// с окончаниями
+	for _, opts := range []writeOptions{{}, {crlf: true}} {
+		small, large := allocs(10, opts), allocs(10000, opts)
+		if large > small+10 {
+			t.Errorf("writeFile(crlf %t) allocates %.0f times for 10 lines and %.0f for 10000", opts.crlf, small, large)
+		}
+	}
+}
+
+// BenchmarkWriteFile записывает буфер в миллион строк.
+func BenchmarkWriteFile(b *testing.B) {
+	lines := benchmarkLines(1000000)
+	name := filepath.Join(b.TempDir(), "big.txt")
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := writeFile(name, lines, writeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestForEachLine(t *testing.T) {
+	tests := []struct {
+		addr string
+		fn   func(n int, line string) (string, bool, error)
+		want []string
+	}{
+		// изменение строк на месте
+		{"", func(n int, line string) (string, bool, error) {
+			return strings.ToUpper(line), false, nil
+		}, []string{"ALPHA", "BETA", "GAMMA", "DELTA"}},
+		{"2,3", func(n int, line string) (string, bool, error) {
+			return strconv.Itoa(n) + ":" + line, false, nil
+		}, []string{"alpha", "2:beta", "3:gamma", "delta"}},
+		// удаление строк
+		{"/a$/;+2", func(n int, line string) (string, bool, error) {
+			return line, strings.Contains(line, "t"), nil
+		}, []string{"alpha", "gamma"}},
+		{",", func(n int, line string) (string, bool, error) {
+			return line, n%2 == 0, nil
+		}, []string{"alpha", "gamma"}},
+	}
+	for _, tt := range tests {
+		state := newTestState("alpha", "beta", "gamma", "delta")
+		state.current = 1
+		if err := state.ForEachLine(tt.addr, tt.fn); err != nil {
+			t.Errorf("ForEachLine(%q): %v", tt.addr, err)
+			continue
+		}
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("ForEachLine(%q): buffer = %q, want %q", tt.addr, state.buffer, tt.want)
+		}
+		if !state.changed {
+			t.Errorf("ForEachLine(%q) did not mark the buffer changed", tt.addr)
+		}
+	}
+}
+
+func TestForEachLineErrors(t *testing.T) {
+	keep := func(n int, line string) (string, bool, error) {
+		return line, false, nil
+	}
+	for _, addr := range []string{"0,2", "5", "2,1", "p", "1p"} {
+		state := newTestState("a", "b", "c")
+		if err := state.ForEachLine(addr, keep); err == nil {
+			t.Errorf("ForEachLine(%q) succeeded, want address error", addr)
+		}
+	}
+
+	// ошибка fn оставляет буфер без изменений, даже если часть строк уже обработана
+	state := newTestState("a", "b", "c")
+	errStop := errors.New("stop")
+	err := state.ForEachLine("", func(n int, line string) (string, bool, error) {
+		if n == 3 {
+			return "", false, errStop
+		}
+		return "changed", n == 1, nil
+	})
+	if err != errStop {
+		t.Errorf("ForEachLine() = %v, want %v", err, errStop)
+	}
+	if !slices.Equal(state.buffer, []string{"a", "b", "c"}) || state.changed {
+		t.Errorf("buffer = %q (changed %t) after failed ForEachLine, want it untouched", state.buffer, state.changed)
+	}
+}
+
+func TestReadOnlyBeforeConfirm(t *testing.T) {
+	state := newTestState("a", "b", "c")
+	state.safe, state.safeLines, state.readOnly = true, 1, true
+	state.in = bufio.NewReader(strings.NewReader("y\n"))
+	for _, line := range []string{",d", ",U"} {
+		if err := state.HandleCommand([]byte(line)); err != errReadOnly {
+			t.Errorf("HandleCommand(%q) = %v, want %v", line, err, errReadOnly)
+		}
+	}
+	if answer, _ := readLine(state.in); string(answer) != "y" {
+		t.Error("read-only command asked for confirmation")
+	}
+	if !slices.Equal(state.buffer, []string{"a", "b", "c"}) {
+		t.Errorf("buffer = %q, want it untouched", state.buffer)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	discardOutput(t)
+	var journal bytes.Buffer
+	state := newTestState("foo1", "bar", "foo2")
+	state.journal = &journal
+	// команды для строк G и данные r - читаются во время выполнения команды
+	state.in = bufio.NewReader(strings.NewReader("d\n\nx\n.dot\n"))
+	for _, line := range []string{"G/foo/", "1r -"} {
+		if err := state.processLine([]byte(line)); err != nil {
+			t.Fatalf("processLine(%q): %v", line, err)
+		}
+	}
+	want := []string{"bar", "x", ".dot", "foo2"}
+	if !slices.Equal(state.buffer, want) {
+		t.Fatalf("buffer = %q, want %q", state.buffer, want)
+	}
+	if want := "G/foo/\nd\n\n1r -\nx\n..dot\n.\n"; journal.String() != want {
+		t.Errorf("journal = %q, want %q", journal.String(), want)
+	}
+	if state.running.Load() || state.global {
+		t.Error("G left the running or global flag set")
+	}
+
+	name := filepath.Join(t.TempDir(), "journal")
+	if err := os.WriteFile(name, journal.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	replay := newTestState("foo1", "bar", "foo2")
+	replay.in = bufio.NewReader(strings.NewReader(""))
+	if err := replay.runScript(name); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(replay.buffer, want) {
+		t.Errorf("replayed buffer = %q, want %q", replay.buffer, want)
+	}
+}
+
+func TestNestedGlobal(t *testing.T) {
+	discardOutput(t)
+	for _, answer := range []string{"G/b/", "1G/b/", "gg"} {
+		state := newTestState("a", "b")
+		state.aliases = map[string]string{"gg": "G/b/"}
+		state.in = bufio.NewReader(strings.NewReader(answer + "\n"))
+		err := state.HandleCommand([]byte("G/a/"))
+		if err == nil || err.Error() != "G cannot be nested" {
+			t.Errorf("G with command %q = %v, want nested G error", answer, err)
+		}
+	}
+}
+
+func TestGlobalTracksLines(t *testing.T) {
+	discardOutput(t)
+	tests := []struct {
+		buffer  []string
+		answers string
+		want    []string
+	}{
+		// вставка ниже совпадения не сдвигает G на чужую строку
+		{[]string{"a1", "b", "a2"}, "$a\\x\nd\n", []string{"a1", "b", "x"}},
+		// удаление выше и правка строки на месте
+		{[]string{"a1", "a2", "a3"}, "1d\nI#\n\n", []string{"#a2", "a3"}},
+		// удаленное совпадение пропускается
+		{[]string{"a1", "a2", "a3"}, "2d\nI#\n", []string{"a1", "#a3"}},
+		// вставка выше
+		{[]string{"b", "a1", "a2"}, "0a\\top\nI#\n", []string{"top", "b", "a1", "#a2"}},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(tt.buffer)...)
+		state.in = bufio.NewReader(strings.NewReader(tt.answers))
+		if err := state.HandleCommand([]byte("G/a/")); err != nil {
+			t.Errorf("G/a/ on %q with %q: %v", tt.buffer, tt.answers, err)
+			continue
+		}
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("G/a/ on %q with %q: buffer = %q, want %q", tt.buffer, tt.answers, state.buffer, tt.want)
+		}
+	}
+}
+
+func TestLineEndingsRecorded(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "crlf.txt")
+	if err := os.WriteFile(name, []byte("l1\r\nl2\r\nl3\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState()
+	out := runCommands(t, state, "e "+name, "f", "L", "w")
+	want := name + ": 3 lines, line 3, unmodified, utf-8, CRLF\nCRLF 2, LF 1, CR 0\n"
+	if !strings.HasPrefix(out, want) {
+		t.Errorf("f and L printed %q, want %q", out, want)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// преобладающее окончание CRLF сохраняется при записи
+	if string(data) != "l1\r\nl2\r\nl3\r\n" {
+		t.Errorf("w wrote %q, want CRLF line endings", data)
+	}
+
+	lf := filepath.Join(dir, "lf.txt")
+	if err := os.WriteFile(lf, []byte("a\nb\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runCommands(t, state, "e "+lf)
+	if state.crlf || state.endings != (endingCounts{lf: 2}) {
+		t.Errorf("e of an LF file: crlf %t, endings %+v", state.crlf, state.endings)
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		width int
+		hard  bool
+		want  []string
+	}{
+		{"short", 10, false, []string{"short"}},
+		// отступ первой части и пробелы между словами сохраняются
+		{"        indented   text with spaces", 23, false, []string{"        indented   text", "with spaces"}},
+		{"\tx y z", 12, false, []string{"\tx y", "z"}},
+		// слово длиннее ширины режется
+		{"a verylongwordhere b", 6, false, []string{"a", "verylo", "ngword", "here b"}},
+		// ширина считается в символах, а не в байтах
+		{"привет мир как дела", 10, false, []string{"привет мир", "как дела"}},
+		{"日本語テキスト", 3, false, []string{"日本語", "テキス", "ト"}},
+		{"abcdefgh", 3, true, []string{"abc", "def", "gh"}},
+		{"ab  cd", 3, true, []string{"ab ", " cd"}},
+	}
+	for _, tt := range tests {
+		got := wrapLine(tt.line, tt.width, tt.hard, 8)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("wrapLine(%q, %d, %t) = %q, want %q", tt.line, tt.width, tt.hard, got, tt.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "text.txt")
+	if err := os.WriteFile(name, []byte("one\ntwo\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState()
+	runCommands(t, state, "e "+name, "1d", "a", "new", ".")
+
+	// e не отбрасывает изменения молча
+	if err := state.HandleCommand([]byte("e")); err == nil {
+		t.Error("e with unsaved changes succeeded, want error")
+	}
+	if !slices.Equal(state.buffer, []string{"two", "new"}) {
+		t.Errorf("buffer = %q after refused e", state.buffer)
+	}
+
+	runCommands(t, state, "e!")
+	if !slices.Equal(state.buffer, []string{"one", "two"}) || state.changed {
+		t.Errorf("after e!: buffer = %q, changed %t; want the file contents, unchanged", state.buffer, state.changed)
+	}
+	// без изменений e перечитывает файл
+	if err := os.WriteFile(name, []byte("three\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runCommands(t, state, "e")
+	if !slices.Equal(state.buffer, []string{"three"}) {
+		t.Errorf("after e: buffer = %q, want [three]", state.buffer)
+	}
+}
+
+func TestJoinBlocks(t *testing.T) {
+	tests := []struct {
+		buffer   []string
+		commands []string
+		want     []string
+	}{
+		// без адреса j/re/ действует на весь буфер, даже с последней строки
+		{[]string{"a", "b", "", "c", "d"}, []string{"j/^$/"}, []string{"ab", "", "cd"}},
+		{[]string{"a", "b", "", "c", "d"}, []string{"1", "j/^$/"}, []string{"ab", "", "cd"}},
+		{[]string{"one ", "  two", "", "three", " , four"}, []string{"j/^$/ f"}, []string{"one two", "", "three, four"}},
+		// граница в начале и подряд идущие границы
+		{[]string{"", "x", "", "", "y", "z"}, []string{"j/^$/"}, []string{"", "x", "", "", "yz"}},
+		// явный диапазон ограничивает объединение
+		{[]string{"a", "b", "", "c", "d"}, []string{"1,2j/^$/"}, []string{"ab", "", "c", "d"}},
+		// без шаблона j по-прежнему объединяет текущую и следующую строки
+		{[]string{"a", "b", "c"}, []string{"1", "j"}, []string{"ab", "c"}},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(tt.buffer)...)
+		runCommands(t, state, tt.commands...)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%q on %q: buffer = %q, want %q", tt.commands, tt.buffer, state.buffer, tt.want)
+		}
+	}
+}
+
+func TestPrevLine(t *testing.T) {
+	state := newTestState("one", "two", "three", "four", "five")
+	runCommands(t, state, "1", "/four/")
+	if state.current != 4 || state.prevLine != 1 {
+		t.Fatalf("after /four/: current %d, prevLine %d; want 4, 1", state.current, state.prevLine)
+	}
+	// '' возвращает к прежнему месту, повторный '' - обратно
+	out := runCommands(t, state, "''p")
+	if out != "one\n" || state.current != 1 || state.prevLine != 4 {
+		t.Errorf("''p printed %q: current %d, prevLine %d; want one, 1, 4", out, state.current, state.prevLine)
+	}
+	runCommands(t, state, "''")
+	if state.current != 4 {
+		t.Errorf("second '': current %d, want 4", state.current)
+	}
+
+	// у другого буфера своя строка '', переключение буфера не переход
+	runCommands(t, state, "b other", "a", "x", "y", "z", ".", "1")
+	if state.prevLine != 3 {
+		t.Errorf("in buffer other: prevLine %d, want 3", state.prevLine)
+	}
+	runCommands(t, state, "b main")
+	if state.current != 4 || state.prevLine != 1 {
+		t.Errorf("back in main: current %d, prevLine %d; want 4, 1", state.current, state.prevLine)
+	}
+	if out := runCommands(t, state, "''p"); out != "one\n" {
+		t.Errorf("''p in main printed %q, want one", out)
+	}
+}
+
+func TestLineAtOffset(t *testing.T) {
+	tests := []struct {
+		encoding string
+		crlf     bool
+		offsets  []int // первое смещение каждой строки и смещение за концом
+	}{
+		// "два" в UTF-8 занимает 6 байт
+		{"utf-8", false, []int{0, 4, 11, 13}},
+		// в cp1251 - 3 байта
+		{"cp1251", false, []int{0, 4, 8, 10}},
+		{"utf-8", true, []int{0, 5, 13, 16}},
+		{"cp1251", true, []int{0, 5, 10, 13}},
+	}
+	for _, tt := range tests {
+		state := newTestState("abc", "два", "x")
+		state.encoding, _ = lookupCharmap(tt.encoding)
+		state.crlf = tt.crlf
+		for i, off := range tt.offsets[:3] {
+			if got := state.lineAtOffset(off); got != i+1 {
+				t.Errorf("%s, crlf %t: lineAtOffset(%d) = %d, want %d", tt.encoding, tt.crlf, off, got, i+1)
+			}
+			// последний байт строки - ее окончание
+			if got := state.lineAtOffset(tt.offsets[i+1] - 1); got != i+1 {
+				t.Errorf("%s, crlf %t: lineAtOffset(%d) = %d, want %d", tt.encoding, tt.crlf, tt.offsets[i+1]-1, got, i+1)
+			}
+		}
+		end := tt.offsets[3]
+		if got := state.lineAtOffset(end); got != -1 {
+			t.Errorf("%s, crlf %t: lineAtOffset(%d) past the end = %d, want -1", tt.encoding, tt.crlf, end, got)
+		}
+		// адрес за концом буфера - ошибка
+		if err := state.HandleCommand([]byte("#" + strconv.Itoa(end) + "p")); err == nil {
+			t.Errorf("%s, crlf %t: #%dp succeeded, want error", tt.encoding, tt.crlf, end)
+		}
+	}
+
+	state := newTestState("abc", "два", "x")
+	if out := runCommands(t, state, "#5p", "#11p"); out != "два\nx\n" {
+		t.Errorf("#5p and #11p printed %q", out)
+	}
+}
+
+func TestEvalLines(t *testing.T) {
+	var ran []string
+	shell := func(cmdline string) ([]string, error) {
+		ran = append(ran, cmdline)
+		switch cmdline {
+		case "fail":
+			return nil, errors.New("!fail: exit status 1")
+		case "none":
+			return nil, nil
+		}
+		return []string{cmdline + " 1", cmdline + " 2"}, nil
+	}
+	tests := []struct {
+		command string
+		want    []string
+		ran     []string
+		out     string
+	}{
+		{"Z", []string{"top", "top 1", "top 2", "", "fail", "? !fail: exit status 1", "none", "cmd", "cmd 1", "cmd 2"},
+			[]string{"top", "fail", "none", "cmd"}, "4\n"},
+		// строки вне диапазона не выполняются и не сдвигаются
+		{"3,4Z", []string{"top", "", "fail", "? !fail: exit status 1", "none", "cmd"},
+			[]string{"fail", "none"}, "2\n"},
+		{"5Z", []string{"top", "", "fail", "none", "cmd", "cmd 1", "cmd 2"},
+			[]string{"cmd"}, "1\n"},
+	}
+	for _, tt := range tests {
+		ran = nil
+		state := newTestState("top", "", "fail", "none", "cmd")
+		state.shell = shell
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer = %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if !slices.Equal(ran, tt.ran) {
+			t.Errorf("%s ran %q, want %q", tt.command, ran, tt.ran)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+	}
+}
+
+func TestFillJoin(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"one", "two"}, "one two"},
+		// пробелы и табуляции на стыке заменяются одним пробелом
+		{[]string{"one  \t", "\t  two", "three "}, "one two three"},
+		{[]string{"  indented", "  next"}, "  indented next"},
+		// после конца предложения пробел остается
+		{[]string{"End.", "Next one!", "And?", "more"}, "End. Next one! And? more"},
+		// перед перенесенным знаком препинания пробела нет
+		{[]string{"word", " , more", "(aside", ")", "done", "."}, "word, more (aside) done."},
+		// пустые строки и строки из пробелов пропускаются
+		{[]string{"a", "", "   ", "b"}, "a b"},
+		{[]string{"", "  b"}, "b"},
+		{[]string{"слово ", "  другое"}, "слово другое"},
+	}
+	for _, tt := range tests {
+		if got := fillJoin(tt.lines); got != tt.want {
+			t.Errorf("fillJoin(%q) = %q, want %q", tt.lines, got, tt.want)
+		}
+	}
+
+	state := newTestState("x", "one  ", "  two.", "  Three", "y")
+	runCommands(t, state, "2,4j f")
+	if !slices.Equal(state.buffer, []string{"x", "one two. Three", "y"}) {
+		t.Errorf("2,4j f: buffer = %q", state.buffer)
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "part")
+	state := newTestState()
+	for i := range 30 {
+		state.buffer = append(state.buffer, "line "+strconv.Itoa(i)+" ёж")
+	}
+	state.current = len(state.buffer)
+	reassemble := func() string {
+		files, err := filepath.Glob(name + ".*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var all []byte
+		for _, fn := range files {
+			data, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) > 40 {
+				t.Errorf("%s is %d bytes, want at most 40", fn, len(data))
+			}
+			all = append(all, data...)
+		}
+		return string(all)
+	}
+	want := strings.Join(state.buffer, "\n") + "\n"
+
+	out := runCommands(t, state, "w +40 "+name)
+	if got := reassemble(); got != want {
+		t.Errorf("w +40: parts reassemble to %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(out, name+".001 ") {
+		t.Errorf("w +40 printed %q", out)
+	}
+
+	// части от прежней, более длинной записи удаляются
+	state.buffer = state.buffer[:5]
+	state.current = 5
+	out = runCommands(t, state, "w +40 "+name)
+	if got, want := reassemble(), strings.Join(state.buffer, "\n")+"\n"; got != want {
+		t.Errorf("second w +40: parts reassemble to %q, want %q", got, want)
+	}
+	if !strings.Contains(out, name+".004 removed\n") {
+		t.Errorf("second w +40 printed %q, want removed parts listed", out)
+	}
+}
+
+func TestBinaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"nul.bin":  "text\x00more\n",
+		"utf8.bin": "abc\xff\xfe\n",
+	}
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range []string{"e ", "r "} {
+			state := newTestState("keep")
+			if err := state.HandleCommand([]byte(cmd + fn)); !errors.Is(err, errBinary) {
+				t.Errorf("%s%s = %v, want errBinary", cmd, name, err)
+			}
+			if !slices.Equal(state.buffer, []string{"keep"}) {
+				t.Errorf("%s%s: buffer = %q after refusal", cmd, name, state.buffer)
+			}
+		}
+
+		want := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+		state := newTestState()
+		runCommands(t, state, "e! "+fn)
+		if !slices.Equal(state.buffer, want) || state.filename != fn {
+			t.Errorf("e! %s: buffer %q, filename %q", name, state.buffer, state.filename)
+		}
+		state = newTestState("keep")
+		runCommands(t, state, "r! "+fn)
+		if !slices.Equal(state.buffer, append([]string{"keep"}, want...)) {
+			t.Errorf("r! %s: buffer %q", name, state.buffer)
+		}
+	}
+
+	// в однобайтовой кодировке любой байт, кроме NUL, допустим
+	fn := filepath.Join(dir, "cp1251.txt")
+	if err := os.WriteFile(fn, []byte("\xcf\xf0\xe8\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState()
+	state.encoding, _ = lookupCharmap("cp1251")
+	runCommands(t, state, "e "+fn)
+	if !slices.Equal(state.buffer, []string{"При"}) {
+		t.Errorf("e of a cp1251 file: buffer %q", state.buffer)
+	}
+}
+
+func TestReadCommandOutput(t *testing.T) {
+	var ran string
+	shell := func(cmdline string) ([]string, error) {
+		ran = cmdline
+		return []string{"out 1", "out 2"}, nil
+	}
+	tests := []struct {
+		command string
+		want    []string
+		current int
+	}{
+		{"1r !ls -l", []string{"a", "out 1", "out 2", "b", "c"}, 3},
+		{"0r !ls -l", []string{"out 1", "out 2", "a", "b", "c"}, 2},
+		{"2r !ls -l", []string{"a", "b", "out 1", "out 2", "c"}, 4},
+		// без адреса вывод добавляется в конец буфера
+		{"r !ls -l", []string{"a", "b", "c", "out 1", "out 2"}, 5},
+		{"/b/r !ls -l", []string{"a", "b", "out 1", "out 2", "c"}, 4},
+	}
+	for _, tt := range tests {
+		ran = ""
+		state := newTestState("a", "b", "c")
+		state.shell = shell
+		runCommands(t, state, tt.command)
+		if ran != "ls -l" {
+			t.Errorf("%s ran %q, want %q", tt.command, ran, "ls -l")
+		}
+		if !slices.Equal(state.buffer, tt.want) || state.current != tt.current || !state.changed {
+			t.Errorf("%s: buffer %q, current %d, changed %t; want %q, %d, true",
+				tt.command, state.buffer, state.current, state.changed, tt.want, tt.current)
+		}
+	}
+
+	// настоящая оболочка
+	state := newTestState("a", "b")
+	runCommands(t, state, "1r !printf 'x\\ny\\n'")
+	if !slices.Equal(state.buffer, []string{"a", "x", "y", "b"}) {
+		t.Errorf("1r !printf: buffer %q", state.buffer)
+	}
+}
+
+func TestUniq(t *testing.T) {
+	buffer := []string{"x", "a", "a", "b", "a", "b", "b", "y"}
+	tests := []struct {
+		command string
+		want    []string
+		out     string
+	}{
+		// без флагов удаляются только повторы подряд
+		{"U", []string{"x", "a", "b", "a", "b", "y"}, ""},
+		{"U a", []string{"x", "a", "b", "y"}, ""},
+		// c только считает, буфер не меняется
+		{"U c", buffer, "2\n"},
+		{"U ac", buffer, "4\n"},
+		// строки вне диапазона сохраняются, даже если повторяют строки в нем
+		{"3,6U a", []string{"x", "a", "a", "b", "b", "y"}, ""},
+		{"2,3U", []string{"x", "a", "b", "a", "b", "b", "y"}, ""},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+		if changed := !slices.Equal(tt.want, buffer); state.changed != changed {
+			t.Errorf("%s: changed %t, want %t", tt.command, state.changed, changed)
+		}
+	}
+}
+
+func TestInterruptScan(t *testing.T) {
+	discardOutput(t)
+	lines := benchmarkLines(10000)
+	for _, command := range []string{"F/error/", "X/error/", "U a", "X/error/v"} {
+		state := newTestState(slices.Clone(lines)...)
+		cmd, err := state.parseCommand([]byte(command))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// SIGINT пришел, пока команда просматривает буфер
+		state.running.Store(true)
+		sigs := make(chan os.Signal)
+		done := make(chan struct{})
+		go func() {
+			state.watchInterrupt(sigs)
+			close(done)
+		}()
+		sigs <- os.Interrupt
+		close(sigs)
+		<-done
+		if err := cmd.handler(state, cmd.args); !errors.Is(err, errInterrupted) {
+			t.Errorf("%s = %v, want errInterrupted", command, err)
+		}
+		if !slices.Equal(state.buffer, lines) || state.changed {
+			t.Errorf("%s: buffer changed by an interrupted command", command)
+		}
+	}
+
+	// вне команды SIGINT ничего не прерывает
+	state := newTestState("a")
+	sigs := make(chan os.Signal, 1)
+	sigs <- os.Interrupt
+	close(sigs)
+	state.watchInterrupt(sigs)
+	if state.interrupted.Load() {
+		t.Error("SIGINT at the prompt set interrupted")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		buffer  []string
+		command string
+		want    []string
+	}{
+		{[]string{"a,b,c"}, "S ,", []string{"a", "b", "c"}},
+		// многосимвольный разделитель берется как есть, вместе с пробелами
+		{[]string{"a, b,c, d"}, "S , ", []string{"a", "b,c", "d"}},
+		{[]string{"one::two::::three"}, "S ::", []string{"one", "two", "", "three"}},
+		// начальные пробелы разделителя сохраняет только форма \
+		{[]string{"x -> y -> z"}, "S  -> ", []string{"x ", "y ", "z"}},
+		{[]string{"x -> y -> z"}, "S\\ -> ", []string{"x", "y", "z"}},
+		// /re/ - регулярное выражение
+		{[]string{"a1b22c333d"}, "S /[0-9]+/", []string{"a", "b", "c", "d"}},
+		{[]string{"a ,b;  c"}, "S /\\s*[,;]\\s*/", []string{"a", "b", "c"}},
+		// разделитель \ с экранированием
+		{[]string{"a\tb\tc"}, "S\\\\t", []string{"a", "b", "c"}},
+		{[]string{"a b  c"}, "S\\ ", []string{"a", "b", "", "c"}},
+		// строки без разделителя и вне диапазона не меняются
+		{[]string{"x,y", "no delim", "p,q"}, "1,2S ,", []string{"x", "y", "no delim", "p,q"}},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(tt.buffer)...)
+		runCommands(t, state, "1", tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%q on %q: buffer %q, want %q", tt.command, tt.buffer, state.buffer, tt.want)
+		}
+	}
+
+	state := newTestState("a,b")
+	for _, command := range []string{"S", "S /[/"} {
+		if err := state.HandleCommand([]byte(command)); err == nil {
+			t.Errorf("%q succeeded, want error", command)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cp1251, _ := lookupCharmap("cp1251")
+	tests := []struct {
+		setup func(*State)
+		want  string
+	}{
+		{func(*State) {}, "(no file): 3 lines, line 3, unmodified, utf-8, LF\n"},
+		{func(s *State) {
+			s.filename, s.current, s.changed = "notes.txt", 2, true
+		}, "notes.txt: 3 lines, line 2, modified, utf-8, LF\n"},
+		{func(s *State) {
+			s.filename, s.partial, s.crlf, s.encoding = "big.txt", true, true, cp1251
+		}, "big.txt: 3 lines, line 3, unmodified, partial, cp1251, CRLF\n"},
+		{func(s *State) {
+			s.buffer, s.current = nil, 0
+		}, "(no file): 0 lines, line 0, unmodified, utf-8, LF\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState("a", "b", "c")
+		tt.setup(state)
+		if out := runCommands(t, state, "f"); out != tt.want {
+			t.Errorf("f printed %q, want %q", out, tt.want)
+		}
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.txt"), filepath.Join(dir, "second.txt")
+	if err := os.WriteFile(first, []byte("1\n2\n3\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("x\ny\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState()
+	runCommands(t, state, "e "+first, "2d", "1")
+	runCommands(t, state, "b other", "e "+second, "2")
+
+	// новый буфер не видит изменений первого
+	if !slices.Equal(state.buffer, []string{"x", "y"}) || state.filename != second || state.changed || state.current != 2 {
+		t.Errorf("buffer other: %q, %q, changed %t, current %d", state.buffer, state.filename, state.changed, state.current)
+	}
+	runCommands(t, state, "a", "z", ".")
+
+	runCommands(t, state, "b main")
+	if !slices.Equal(state.buffer, []string{"1", "3"}) || state.filename != first || !state.changed || state.current != 1 {
+		t.Errorf("buffer main: %q, %q, changed %t, current %d", state.buffer, state.filename, state.changed, state.current)
+	}
+	// запись одного буфера не сбрасывает признак изменения другого
+	runCommands(t, state, "w")
+	out := runCommands(t, state, "b")
+	if !strings.Contains(out, "*  main            2 "+first+"\n") || !strings.Contains(out, " + other           3 "+second+"\n") {
+		t.Errorf("b printed %q", out)
+	}
+
+	runCommands(t, state, "b other")
+	if !slices.Equal(state.buffer, []string{"x", "y", "z"}) || state.filename != second || !state.changed || state.current != 3 {
+		t.Errorf("buffer other again: %q, %q, changed %t, current %d", state.buffer, state.filename, state.changed, state.current)
+	}
+	if data, _ := os.ReadFile(second); string(data) != "x\ny\n" {
+		t.Errorf("%s = %q, want it untouched", second, data)
+	}
+	if data, _ := os.ReadFile(first); string(data) != "1\n3\n" {
+		t.Errorf("%s = %q after w in main", first, data)
+	}
+}
+
+func TestCommandCount(t *testing.T) {
+	tests := []struct {
+		commands []string
+		want     []string
+		out      string
+	}{
+		{[]string{"2p3"}, []string{"1", "2", "3", "4", "5"}, "2\n3\n4\n"},
+		// без адреса счет идет от текущей строки
+		{[]string{"1", "p5"}, []string{"1", "2", "3", "4", "5"}, "1\n1\n2\n3\n4\n5\n"},
+		{[]string{"2j3"}, []string{"1", "234", "5"}, ""},
+		{[]string{"1", "j3"}, []string{"123", "4", "5"}, "1\n"},
+		{[]string{"4d2"}, []string{"1", "2", "3"}, ""},
+		// число перед командой - адрес, а не счетчик
+		{[]string{"3d"}, []string{"1", "2", "4", "5"}, ""},
+	}
+	for _, tt := range tests {
+		state := newTestState("1", "2", "3", "4", "5")
+		out := runCommands(t, state, tt.commands...)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%q: buffer %q, want %q", tt.commands, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%q printed %q, want %q", tt.commands, out, tt.out)
+		}
+	}
+
+	errs := map[string]string{
+		"p0":  "invalid count",
+		"j0":  "invalid count",
+		"4p3": "invalid address",
+		"d9":  "invalid address",
+		"5j2": "invalid address",
+	}
+	for command, want := range errs {
+		state := newTestState("1", "2", "3", "4", "5")
+		err := state.HandleCommand([]byte(command))
+		if err == nil || err.Error() != want {
+			t.Errorf("%s = %v, want %q", command, err, want)
+		}
+		if len(state.buffer) != 5 {
+			t.Errorf("%s changed the buffer to %q", command, state.buffer)
+		}
+	}
+}
+
+func TestShellErrors(t *testing.T) {
+	for _, command := range []string{"r !", "e !"} {
+		state := newTestState("keep")
+		err := state.HandleCommand([]byte(command + "echo out; echo oops >&2; exit 1"))
+		want := "!echo out; echo oops >&2; exit 1: exit status 1: oops"
+		if err == nil || err.Error() != want {
+			t.Errorf("%s with a failing command = %v, want %q", command, err, want)
+		}
+		// вывод неудачной команды в буфер не попадает
+		if !slices.Equal(state.buffer, []string{"keep"}) || state.changed {
+			t.Errorf("%s with a failing command: buffer %q, changed %t", command, state.buffer, state.changed)
+		}
+	}
+
+	// без stderr сообщение содержит только код завершения
+	state := newTestState()
+	if err := state.HandleCommand([]byte("r !exit 3")); err == nil || err.Error() != "!exit 3: exit status 3" {
+		t.Errorf("r !exit 3 = %v", err)
+	}
+
+	// длинный stderr обрезается до shellErrMax байт, не разрывая символ
+	_, err := runShell("printf x >&2; printf 'я%.0s' $(seq 300) >&2; exit 1")
+	if err == nil {
+		t.Fatal("runShell() succeeded, want error")
+	}
+	msg := err.Error()[strings.LastIndex(err.Error(), ": ")+2:]
+	if !strings.HasSuffix(msg, "...") || len(msg) > shellErrMax+3 || !utf8.ValidString(msg) {
+		t.Errorf("runShell() stderr in the error = %q (%d bytes), want at most %d bytes and ...", msg, len(msg), shellErrMax)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	buffer := []string{"\t  a  \t b\t", " \tx", "  \t \ty  z", "clean", "\x1b[31mred\x1b[0m  text"}
+	tests := []struct {
+		flags string
+		want  []string
+		out   string
+	}{
+		// c: серии пробелов внутри строки и в конце, отступ не меняется
+		{"", []string{"\t  a b", " \tx", "  \t \ty z", "clean", "\x1b[31mred\x1b[0m text"}, "3\n"},
+		{" c", []string{"\t  a b", " \tx", "  \t \ty z", "clean", "\x1b[31mred\x1b[0m text"}, "3\n"},
+		// i: табуляции в отступе до следующей позиции табуляции, внутри строки без изменений
+		{" i", []string{"          a  \t b\t", "        x", "                y  z", "clean", "\x1b[31mred\x1b[0m  text"}, "3\n"},
+		{" ci", []string{"          a b", "        x", "                y z", "clean", "\x1b[31mred\x1b[0m text"}, "4\n"},
+		{" a", []string{"\t  a  \t b\t", " \tx", "  \t \ty  z", "clean", "red  text"}, "1\n"},
+		{" ac", []string{"\t  a b", " \tx", "  \t \ty z", "clean", "red text"}, "3\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		out := runCommands(t, state, "N"+tt.flags)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("N%s: buffer %q, want %q", tt.flags, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("N%s printed %q, want %q", tt.flags, out, tt.out)
+		}
+	}
+
+	// шаг табуляции берется из настройки
+	state := newTestState("\tx", " \t\ty")
+	state.tabWidth = 4
+	runCommands(t, state, "N i")
+	if !slices.Equal(state.buffer, []string{"    x", "        y"}) {
+		t.Errorf("N i with tab width 4: buffer %q", state.buffer)
+	}
+}
+
+func TestSearchWrap(t *testing.T) {
+	// единственное совпадение выше текущей строки
+	state := newTestState("match", "b", "c", "d")
+	runCommands(t, state, "3", "o wrap off")
+	if err := state.HandleCommand([]byte("/match/")); err == nil {
+		t.Error("/match/ without wrap succeeded, want error")
+	}
+	if state.current != 3 {
+		t.Errorf("failed search moved current to %d", state.current)
+	}
+	// назад совпадение находится и без перехода через границу
+	if out := runCommands(t, state, "?match?"); out != "match\n" || state.current != 1 {
+		t.Errorf("?match? printed %q, current %d", out, state.current)
+	}
+
+	// с o wrap поиск продолжается с начала буфера
+	runCommands(t, state, "3", "o wrap on")
+	if out := runCommands(t, state, "/match/"); out != "match\n" || state.current != 1 {
+		t.Errorf("/match/ with wrap printed %q, current %d", out, state.current)
+	}
+	// и назад - с конца
+	state = newTestState("a", "b", "match")
+	state.current = 2
+	state.searchWrap = false
+	if err := state.HandleCommand([]byte("?match?")); err == nil {
+		t.Error("?match? without wrap succeeded, want error")
+	}
+	state.searchWrap = true
+	if out := runCommands(t, state, "?match?"); out != "match\n" || state.current != 3 {
+		t.Errorf("?match? with wrap printed %q, current %d", out, state.current)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC)
+	tests := []struct {
+		text   string
+		layout string
+		want   string
+	}{
+		{"# %f, %d", "2006-01-02", "# notes.txt, 2024-03-05"},
+		{"%d", "15:04:05", "14:07:09"},
+		{"100%% done", "2006", "100% done"},
+		// %%d - символ %, за которым идет d
+		{"%%d %%f", "2006", "%d %f"},
+		// неизвестные последовательности и % в конце остаются как есть
+		{"50%x %", "2006", "50%x %"},
+		{"%f%f", "2006", "notes.txtnotes.txt"},
+		{"год %d", "2006", "год 2024"},
+	}
+	for _, tt := range tests {
+		if got := expandTemplate(tt.text, "notes.txt", now, tt.layout); got != tt.want {
+			t.Errorf("expandTemplate(%q, %q) = %q, want %q", tt.text, tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	state := newTestState("короткая", "очень длинная строка текста", "日本語のテキストですね", "0123456789")
+	runCommands(t, state, "o fold on", "o width 10")
+	out := runCommands(t, state, "1,$p")
+	// ширина считается в символах, последний видимый заменяется на …
+	want := "короткая\nочень дли…\n日本語のテキストで…\n0123456789\n"
+	if out != want {
+		t.Errorf("p with fold printed %q, want %q", out, want)
+	}
+	// номер строки занимает 4 позиции из ширины
+	out = runCommands(t, state, "1,$#")
+	want = "1   корот…\n2   очень…\n3   日本語のテ…\n4   01234…\n"
+	if out != want {
+		t.Errorf("# with fold printed %q, want %q", out, want)
+	}
+	// буфер при этом не меняется
+	if state.buffer[1] != "очень длинная строка текста" {
+		t.Errorf("fold changed the buffer: %q", state.buffer[1])
+	}
+	runCommands(t, state, "o fold off")
+	if out := runCommands(t, state, "2p"); out != "очень длинная строка текста\n" {
+		t.Errorf("p without fold printed %q", out)
+	}
+}
+
+func TestTabWidthColumns(t *testing.T) {
+	tests := []struct {
+		tab     int
+		columns int
+		fold    string
+		wrap    []string
+	}{
+		// табуляция доходит до следующей позиции, кратной tabwidth
+		{8, 17, "\ta…", []string{"\tab", "cd"}},
+		{4, 9, "\tabcde…", []string{"\tab cd"}},
+		{2, 7, "\tabcdefg", []string{"\tab cd"}},
+	}
+	for _, tt := range tests {
+		if got := truncateLine("\tabcdefg", 10, tt.tab); got != tt.fold {
+			t.Errorf("truncateLine with tab %d = %q, want %q", tt.tab, got, tt.fold)
+		}
+		if got := columns("\tab\tc", tt.tab); got != tt.columns {
+			t.Errorf("columns with tab %d = %d, want %d", tt.tab, got, tt.columns)
+		}
+
+		state := newTestState("\tab cd")
+		runCommands(t, state, "o tabwidth "+strconv.Itoa(tt.tab), "W 10")
+		if !slices.Equal(state.buffer, tt.wrap) {
+			t.Errorf("W 10 with tabwidth %d: buffer %q, want %q", tt.tab, state.buffer, tt.wrap)
+		}
+	}
+
+	// o tabwidth меняет и обрезку при печати
+	state := newTestState("\tabcdef")
+	runCommands(t, state, "o fold on", "o width 12")
+	if out := runCommands(t, state, "p"); out != "\tabc…\n" {
+		t.Errorf("p with tabwidth 8 printed %q", out)
+	}
+	runCommands(t, state, "o tabwidth 4")
+	if out := runCommands(t, state, "p"); out != "\tabcdef\n" {
+		t.Errorf("p with tabwidth 4 printed %q", out)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	state := newTestState("alpha", "beta", "alphabet", "gamma", "delta")
+	state.current = 2
+	tests := []struct {
+		command string
+		out     string
+	}{
+		{"F/alpha/", "1   alpha\n3   alphabet\n"},
+		{"F/a$/", "1   alpha\n2   beta\n4   gamma\n5   delta\n"},
+		// диапазон ограничивает поиск, номера остаются номерами буфера
+		{"3,$F/a/", "3   alphabet\n4   gamma\n5   delta\n"},
+		{"F/none/", ""},
+	}
+	for _, tt := range tests {
+		if out := runCommands(t, state, tt.command); out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+		// F не меняет ни буфер, ни текущую строку
+		if state.current != 2 || state.changed {
+			t.Errorf("%s: current %d, changed %t", tt.command, state.current, state.changed)
+		}
+	}
+	if err := state.HandleCommand([]byte("F/a/p")); err == nil {
+		t.Error("F/a/p succeeded, want error")
+	}
+}
+
+func TestStartupFile(t *testing.T) {
+	dir := t.TempDir()
+	rc := filepath.Join(dir, "startup")
+	script := "o prompt > \no inputprompt : \no tabwidth 4\no nosuch\no safelines many\no wrap off\na\nunterminated\n"
+	if err := os.WriteFile(rc, []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState()
+	out := captureOutput(t, func() { state.runStartup(rc) })
+
+	if state.prompt != "> " || state.inputPrompt != ": " || state.tabWidth != 4 || state.searchWrap {
+		t.Errorf("after startup: prompt %q, inputprompt %q, tabwidth %d, wrap %t",
+			state.prompt, state.inputPrompt, state.tabWidth, state.searchWrap)
+	}
+	// ошибки печатаются с номером строки и не прерывают выполнение
+	if !strings.Contains(out, rc+":4: ") || !strings.Contains(out, rc+":5: ") {
+		t.Errorf("startup printed %q, want errors for lines 4 and 5", out)
+	}
+	// незавершенный ввод текста не оставляет редактор в режиме добавления
+	if state.mode != modeCommand || !slices.Equal(state.buffer, []string{"unterminated"}) {
+		t.Errorf("after startup: mode %v, buffer %q", state.mode, state.buffer)
+	}
+
+	// без -x читается ~/.edrc, его отсутствие - не ошибка
+	t.Setenv("HOME", dir)
+	state = newTestState()
+	if out := captureOutput(t, func() { state.runStartup("") }); out != "" || state.prompt != "" {
+		t.Errorf("startup without ~/%s printed %q, prompt %q", rcFile, out, state.prompt)
+	}
+	if err := os.WriteFile(filepath.Join(dir, rcFile), []byte("o prompt * \n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	captureOutput(t, func() { state.runStartup("") })
+	if state.prompt != "* " {
+		t.Errorf("prompt from ~/%s = %q", rcFile, state.prompt)
+	}
+
+	// недоступный файл -x только печатает ошибку
+	state = newTestState()
+	if out := captureOutput(t, func() { state.runStartup(filepath.Join(dir, "missing")) }); !strings.Contains(out, "missing") {
+		t.Errorf("startup with a missing file printed %q", out)
+	}
+}
+
+func TestPrintNumbered(t *testing.T) {
+	state := newTestState("a", "b", "c", "d")
+	state.current = 1
+	if out := runCommands(t, state, "2,3#"); out != "2   b\n3   c\n" {
+		t.Errorf("2,3# printed %q", out)
+	}
+	// # переносит текущую строку, но не включает постоянные номера
+	if state.current != 3 || state.lineNumbers {
+		t.Errorf("after 2,3#: current %d, lineNumbers %t; want 3, false", state.current, state.lineNumbers)
+	}
+	// без адреса, как p, печатает весь буфер
+	if out := runCommands(t, state, "#"); out != "1   a\n2   b\n3   c\n4   d\n" || state.current != 4 {
+		t.Errorf("# printed %q, current %d", out, state.current)
+	}
+	if out := runCommands(t, state, "1p"); out != "a\n" {
+		t.Errorf("p after # printed %q", out)
+	}
+
+	// при включенных номерах # их не выключает
+	state.lineNumbers = true
+	runCommands(t, state, "$#")
+	if state.current != 4 || !state.lineNumbers {
+		t.Errorf("after $#: current %d, lineNumbers %t; want 4, true", state.current, state.lineNumbers)
+	}
+}
+
+func TestAppendInline(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		current int
+	}{
+		{`0a\x\ny`, []string{"x", "y", "a", "b"}, 2},
+		{`$a\last`, []string{"a", "b", "last"}, 3},
+		{`1a\mid`, []string{"a", "mid", "b"}, 2},
+		// без адреса - в конец буфера
+		{`a\end`, []string{"a", "b", "end"}, 3},
+		{`a\\ttab\\slash\x`, []string{"a", "b", "\ttab\\slash\\x"}, 3},
+		{`0a\`, []string{"", "a", "b"}, 1},
+	}
+	for _, tt := range tests {
+		state := newTestState("a", "b")
+		runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) || state.current != tt.current || state.mode != modeCommand {
+			t.Errorf("%s: buffer %q, current %d, mode %v; want %q, %d, command mode",
+				tt.command, state.buffer, state.current, state.mode, tt.want, tt.current)
+		}
+	}
+
+	// в пустой буфер
+	state := newTestState()
+	runCommands(t, state, `0a\one\ntwo`)
+	if !slices.Equal(state.buffer, []string{"one", "two"}) {
+		t.Errorf("0a in an empty buffer: %q", state.buffer)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	state := newTestState("one", "two", "three", "four")
+	runCommands(t, state, "A head 1p", "A cut 2,3d", "A show ,p")
+	if out := runCommands(t, state, "head"); out != "one\n" {
+		t.Errorf("head printed %q", out)
+	}
+	// псевдоним с адресом выполняет адресованную команду
+	runCommands(t, state, "cut")
+	if !slices.Equal(state.buffer, []string{"one", "four"}) {
+		t.Errorf("after cut: buffer %q", state.buffer)
+	}
+	// остаток строки дописывается к тексту команды
+	runCommands(t, state, "A grep F")
+	if out := runCommands(t, state, "grep /our/"); out != "2   four\n" {
+		t.Errorf("grep /our/ printed %q", out)
+	}
+	// имена кириллицей ничего не перекрывают
+	runCommands(t, state, "A верх 1p")
+	if out := runCommands(t, state, "верх"); out != "one\n" {
+		t.Errorf("верх printed %q", out)
+	}
+	if out := runCommands(t, state, "A"); out != "cut 2,3d\ngrep F\nhead 1p\nshow ,p\nверх 1p\n" {
+		t.Errorf("A printed %q", out)
+	}
+
+	runCommands(t, state, "A head")
+	if _, ok := state.aliases["head"]; ok {
+		t.Error("A head did not remove the alias")
+	}
+
+	runCommands(t, state, "A ca cb", "A cb ca")
+	errs := map[string]string{
+		"ca":        `alias loop in "ca"`,
+		"A print p": `alias "print" would shadow command p`,
+		"A Save w":  `alias "Save" would shadow command S`,
+		"A x1 p":    "alias name must be two or more letters",
+		"A c p":     "alias name must be two or more letters",
+	}
+	for command, want := range errs {
+		if err := state.HandleCommand([]byte(command)); err == nil || err.Error() != want {
+			t.Errorf("%s = %v, want %q", command, err, want)
+		}
+	}
+}
+
+func TestPrintAddress(t *testing.T) {
+	tests := []struct {
+		command string
+		out     string
+	}{
+		{"=", "6\n"},
+		{".=", "3\n"},
+		{"^=", "1\n"},
+		{"$=", "6\n"},
+		{"^+3,$-1=", "4,5\n"},
+		{".-1,.+1=", "2,4\n"},
+		{"+=", "4\n"},
+		{"-2=", "1\n"},
+		{",=", "1,6\n"},
+		{"/5/=", "5\n"},
+		{"?2?=", "2\n"},
+		{"/4/,/6/=", "4,6\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState("1", "2", "3", "4", "5", "6")
+		state.current = 3
+		if out := runCommands(t, state, tt.command); out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+		// = ничего не меняет, даже текущую строку
+		if state.current != 3 {
+			t.Errorf("%s moved current to %d", tt.command, state.current)
+		}
+	}
+	state := newTestState("1", "2")
+	for _, command := range []string{"$+1=", "/none/="} {
+		if err := state.HandleCommand([]byte(command)); err == nil {
+			t.Errorf("%s succeeded, want error", command)
+		}
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	lines := []string{"1", "2", "3", "4", "5", "6"}
+	tests := []struct {
+		command string
+		answer  string
+		want    []string
+		prompt  bool
+		err     string
+	}{
+		{",d", "y\n", []string{}, true, ""},
+		{",d", "n\n", lines, true, "cancelled"},
+		// ответ, отличный от y, - отказ
+		{",d", "yes\n", lines, true, "cancelled"},
+		{"2,5d", "y\n", []string{"1", "6"}, true, ""},
+		// диапазон не больше safelines подтверждения не требует
+		{"2,3d", "", []string{"1", "4", "5", "6"}, false, ""},
+		{"2,4d", "", []string{"1", "5", "6"}, false, ""},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(lines)...)
+		state.safe, state.safeLines = true, 3
+		state.in = bufio.NewReader(strings.NewReader(tt.answer))
+		var err error
+		out := captureOutput(t, func() { err = state.HandleCommand([]byte(tt.command)) })
+		if (err == nil) != (tt.err == "") || err != nil && err.Error() != tt.err {
+			t.Errorf("%s answered %q = %v, want %q", tt.command, tt.answer, err, tt.err)
+		}
+		if prompted := strings.Contains(out, "lines will be affected, continue? (y/n) "); prompted != tt.prompt {
+			t.Errorf("%s printed %q, prompt %t", tt.command, out, tt.prompt)
+		}
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s answered %q: buffer %q, want %q", tt.command, tt.answer, state.buffer, tt.want)
+		}
+	}
+
+	// без o safe подтверждение не запрашивается
+	state := newTestState(slices.Clone(lines)...)
+	state.safeLines = 3
+	if out := runCommands(t, state, ",d"); out != "" || len(state.buffer) != 0 {
+		t.Errorf(",d without safe mode printed %q, buffer %q", out, state.buffer)
+	}
+}
+
+func TestDeleteColumns(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{",C 2 3", []string{"日テキスト", "cé naïve", "ёк", "a", ""}},
+		{",C 1 1", []string{"本語テキスト", "afé naïve", "жик", "", ""}},
+		// колонки за концом короткой строки не трогают ее
+		{",C 3 10", []string{"日本", "ca", "ёж", "a", ""}},
+		{",C 5 6", []string{"日本語テト", "caféaïve", "ёжик", "a", ""}},
+		{"2C 4 4", []string{"日本語テキスト", "caf naïve", "ёжик", "a", ""}},
+	}
+	for _, tt := range tests {
+		state := newTestState("日本語テキスト", "café naïve", "ёжик", "a", "")
+		runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+	}
+
+	state := newTestState("abc")
+	for _, command := range []string{"C", "C 2", "C 0 1", "C 3 2", "C a b"} {
+		if err := state.HandleCommand([]byte(command)); err == nil {
+			t.Errorf("%s succeeded, want error", command)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	state := newTestState("a", "b", "c", "d")
+	runCommands(t, state, "1p", "2d", "$p")
+	if out := runCommands(t, state, "H"); out != "1   1p\n2   2d\n3   $p\n" {
+		t.Errorf("H printed %q", out)
+	}
+	// повторенная команда печатается, выполняется и попадает в историю,
+	// сама команда H - нет
+	if out := runCommands(t, state, "H 1"); out != "1p\na\n" {
+		t.Errorf("H 1 printed %q", out)
+	}
+	runCommands(t, state, "H -3")
+	if !slices.Equal(state.buffer, []string{"a", "d"}) {
+		t.Errorf("after H -3: buffer %q", state.buffer)
+	}
+	if out := runCommands(t, state, "H 3"); out != "$p\nd\n" {
+		t.Errorf("H 3 printed %q", out)
+	}
+	if want := []string{"1p", "2d", "$p", "1p", "2d", "$p"}; !slices.Equal(state.history, want) {
+		t.Errorf("history %q, want %q", state.history, want)
+	}
+	for _, command := range []string{"H 0", "H 7", "H -7", "H x"} {
+		var err error
+		captureOutput(t, func() { err = state.HandleCommand([]byte(command)) })
+		if err == nil {
+			t.Errorf("%s succeeded, want error", command)
+		}
+	}
+
+	// вытесненные записи сохраняют свои номера
+	state = newTestState("a")
+	for i := range historySize + 5 {
+		runCommands(t, state, "A c"+strings.Repeat("x", i+1)+" p")
+	}
+	if err := state.HandleCommand([]byte("H 5")); err == nil {
+		t.Error("H 5 after overflow succeeded, want error")
+	}
+	out := runCommands(t, state, "H")
+	if !strings.HasPrefix(out, "6   A cxxxxxx p\n") || strings.Count(out, "\n") != historySize {
+		t.Errorf("H after overflow printed %d lines starting %q", strings.Count(out, "\n"), out[:min(len(out), 20)])
+	}
+}
+
+func TestReadFiltered(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "log.txt")
+	if err := os.WriteFile(fn, []byte("ok 1\nerror 2\nok 3\nerror 4\nwarn 5\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		command string
+		want    []string
+		out     string
+	}{
+		{"R/error/ " + fn, []string{"a", "b", "error 2", "error 4"}, "2\n"},
+		{"R/error/v " + fn, []string{"a", "b", "ok 1", "ok 3", "warn 5"}, "3\n"},
+		{"0R/^ok/ " + fn, []string{"ok 1", "ok 3", "a", "b"}, "2\n"},
+		{"1R/5$/ " + fn, []string{"a", "warn 5", "b"}, "1\n"},
+		{"R/none/ " + fn, []string{"a", "b"}, "0\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState("a", "b")
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+	}
+
+	state := newTestState("a")
+	for _, command := range []string{"R/error/", "R/[/ " + fn, "R/x/ " + fn + ".missing"} {
+		if err := state.HandleCommand([]byte(command)); err == nil {
+			t.Errorf("%s succeeded, want error", command)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	dir := t.TempDir()
+	script := "a\nfirst\n.second\nthird\n.\n2d\n0a\\top\n$p\nw out.txt\nq\n"
+	if err := os.WriteFile(filepath.Join(dir, "script.ed"), []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := runEditor(t, dir, "", "-f", "script.ed")
+	if code != 0 || stderr != "" {
+		t.Fatalf("ed -f script.ed: exit %d, stderr %q", code, stderr)
+	}
+	if stdout != "third\nGoodbye!\n" {
+		t.Errorf("ed -f script.ed printed %q", stdout)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "top\nfirst\nthird\n" {
+		t.Errorf("out.txt = %q", data)
+	}
+
+	// первая ошибка сценария завершает работу, следующие команды не выполняются
+	bad := "a\nx\n.\n5p\nw bad.txt\nq\n"
+	_, stderr, code = runEditor(t, dir, bad)
+	if code != 1 || stderr != "line 4: invalid address\n" {
+		t.Errorf("script with an error: exit %d, stderr %q; want 1, line 4 error", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.txt")); !os.IsNotExist(err) {
+		t.Error("commands after the error were run")
+	}
+
+	// с -k ошибка печатается, и выполнение продолжается
+	stdout, stderr, code = runEditor(t, dir, bad, "-k")
+	if code != 0 || stderr != "" || !strings.Contains(stdout, "invalid address\n") {
+		t.Errorf("ed -k: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "bad.txt")); string(data) != "x\n" {
+		t.Errorf("ed -k: bad.txt = %q, want the buffer written", data)
+	}
+}
+
+func TestCommentLines(t *testing.T) {
+	original := []string{"func f() {", "\treturn 1", "", "}"}
+	state := newTestState(slices.Clone(original)...)
+	if out := runCommands(t, state, `I\// `); out != "4\n" {
+		t.Errorf("I printed %q", out)
+	}
+	want := []string{"// func f() {", "// \treturn 1", "// ", "// }"}
+	if !slices.Equal(state.buffer, want) {
+		t.Errorf("after I: buffer %q, want %q", state.buffer, want)
+	}
+	if out := runCommands(t, state, `K\// `); out != "4\n" {
+		t.Errorf("K printed %q", out)
+	}
+	if !slices.Equal(state.buffer, original) {
+		t.Errorf("after I and K: buffer %q, want %q", state.buffer, original)
+	}
+
+	// K снимает префикс только у строк, которые с него начинаются
+	state = newTestState("# a", "b", "## c", " # d")
+	if out := runCommands(t, state, "K #"); out != "2\n" {
+		t.Errorf("K # printed %q", out)
+	}
+	if !slices.Equal(state.buffer, []string{" a", "b", "# c", " # d"}) {
+		t.Errorf("after K #: buffer %q", state.buffer)
+	}
+	// без формы \ пробелы вокруг префикса отбрасываются
+	state = newTestState("x", "y", "z")
+	runCommands(t, state, "2,3I   > ", `1I\\t`)
+	if !slices.Equal(state.buffer, []string{"\tx", ">y", ">z"}) {
+		t.Errorf("after I: buffer %q", state.buffer)
+	}
+}
+
+func TestPercentLine(t *testing.T) {
+	tests := []struct {
+		size int
+		pct  int
+		want int
+	}{
+		{1, 0, 1}, {1, 50, 1}, {1, 100, 1},
+		{2, 0, 1}, {2, 50, 1}, {2, 100, 2},
+		{3, 0, 1}, {3, 50, 2}, {3, 100, 3},
+		{10, 0, 1}, {10, 25, 3}, {10, 50, 5}, {10, 99, 10}, {10, 100, 10},
+		{101, 0, 1}, {101, 1, 1}, {101, 50, 51}, {101, 100, 101},
+		// больше 100% - последняя строка
+		{10, 150, 10},
+	}
+	for _, tt := range tests {
+		state := newTestState(benchmarkLines(tt.size)...)
+		if got := state.percentLine(tt.pct); got != tt.want {
+			t.Errorf("percentLine(%d) on %d lines = %d, want %d", tt.pct, tt.size, got, tt.want)
+		}
+	}
+
+	state := newTestState("a", "b", "c", "d")
+	if out := runCommands(t, state, "0%p", "100%p", "50%="); out != "a\nd\n2\n" {
+		t.Errorf("0%%p, 100%%p, 50%%= printed %q", out)
+	}
+	if err := newTestState().HandleCommand([]byte("50%p")); err == nil {
+		t.Error("percent address on an empty buffer succeeded, want error")
+	}
+}
+
+func TestAlignColumns(t *testing.T) {
+	tests := []struct {
+		buffer  []string
+		command string
+		want    []string
+		out     string
+	}{
+		// строки с разным числом полей, ширина в символах
+		{[]string{"name age city", "Жанна 30", "bob 4 Москва extra", ""}, "J",
+			[]string{"name   age  city", "Жанна  30", "bob    4    Москва  extra", ""}, "3\n"},
+		{[]string{"x,yy,z", "длинное,b"}, "J ,", []string{"x,       yy, z", "длинное, b"}, "2\n"},
+		// лишние пробелы между полями схлопываются
+		{[]string{"a    b", "cc d"}, "J", []string{"a   b", "cc  d"}, "2\n"},
+		{[]string{"日本 語", "a b"}, "J", []string{"日本  語", "a   b"}, "2\n"},
+		{[]string{"a b", "c d"}, "J", []string{"a  b", "c  d"}, "2\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(tt.buffer)...)
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s on %q: buffer %q, want %q", tt.command, tt.buffer, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s on %q printed %q, want %q", tt.command, tt.buffer, out, tt.out)
+		}
+	}
+}
+
+func TestReflow(t *testing.T) {
+	buffer := []string{"first para word", "more words here", "", "", "second one", "  spaced   out text", "", "третий абзац из слов"}
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		// пустые строки между абзацами сохраняются, слова абзацев не смешиваются
+		{"P 12", []string{"first para", "word more", "words here", "", "", "second one", "spaced out", "text", "", "третий абзац", "из слов"}},
+		{"P", []string{"first para word more words here", "", "", "second one spaced out text", "", "третий абзац из слов"}},
+		// строки вне диапазона не меняются
+		{"1,2P 10", []string{"first para", "word more", "words here", "", "", "second one", "  spaced   out text", "", "третий абзац из слов"}},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	interval := progressInterval
+	progressInterval = 0
+	defer func() { progressInterval = interval }()
+	discardOutput(t)
+
+	tests := []struct {
+		size     int
+		progress bool
+		lines    int
+	}{
+		// ход проверяется раз в 1024 строки
+		{5000, true, 4},
+		{1000, true, 0},
+		{5000, false, 0},
+	}
+	for _, tt := range tests {
+		for _, command := range []string{"F/error/", "U c"} {
+			state := newTestState(benchmarkLines(tt.size)...)
+			state.progress = tt.progress
+			var err error
+			out := captureStderr(t, func() { err = state.HandleCommand([]byte(command)) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(out, "\n"); got != tt.lines {
+				t.Errorf("%s on %d lines, progress %t: %d progress lines, want %d", command, tt.size, tt.progress, got, tt.lines)
+			}
+			if tt.lines > 0 && !strings.HasPrefix(out, "processed 1024/"+strconv.Itoa(tt.size)+" lines\n") {
+				t.Errorf("%s on %d lines printed %q", command, tt.size, out)
+			}
+		}
+	}
+}
+
+func TestPromptString(t *testing.T) {
+	state := newTestState("a")
+	runCommands(t, state, "o prompt * ", "o inputprompt > ")
+	if got := state.promptString(); got != "* " {
+		t.Errorf("command mode prompt = %q, want %q", got, "* ")
+	}
+	runCommands(t, state, "a")
+	if got := state.promptString(); got != "> " {
+		t.Errorf("append mode prompt = %q, want %q", got, "> ")
+	}
+	runCommands(t, state, ".")
+	if got := state.promptString(); got != "* " {
+		t.Errorf("prompt after . = %q, want %q", got, "* ")
+	}
+	// пустое приглашение не печатается
+	state = newTestState()
+	if got := state.promptString(); got != "" {
+		t.Errorf("default prompt = %q, want none", got)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	lines := []string{`say "hi"`, `C:\path\to`, `\"both\"`, "tab\there", "", "юникод"}
+	fn := filepath.Join(t.TempDir(), "lines.json")
+	state := newTestState(slices.Clone(lines)...)
+	runCommands(t, state, "O "+fn)
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []string
+	if err := json.Unmarshal(data, &decoded); err != nil || !slices.Equal(decoded, lines) {
+		t.Errorf("O wrote %s: %v", data, err)
+	}
+	// O - печатает массив
+	printed := "[\n" + `  "say \"hi\"",` + "\n" + `  "C:\\path\\to"` + "\n]\n"
+	if out := runCommands(t, state, "1,2O -"); out != printed {
+		t.Errorf("1,2O - printed %q", out)
+	}
+
+	state = newTestState("first", "last")
+	if out := runCommands(t, state, "1Y "+fn); out != "6\n" {
+		t.Errorf("Y printed %q", out)
+	}
+	want := append(append([]string{"first"}, lines...), "last")
+	if !slices.Equal(state.buffer, want) {
+		t.Errorf("after Y: buffer %q, want %q", state.buffer, want)
+	}
+
+	// файл не с массивом строк - ошибка, буфер не меняется
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"a": 1}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state = newTestState("x")
+	if err := state.HandleCommand([]byte("Y " + bad)); err == nil || !slices.Equal(state.buffer, []string{"x"}) {
+		t.Errorf("Y of a non-array = %v, buffer %q", err, state.buffer)
+	}
+}
+
+func TestSplitFiles(t *testing.T) {
+	dir := t.TempDir()
+	head, tail := filepath.Join(dir, "head.txt"), filepath.Join(dir, "tail.txt")
+	state := newTestState("one", "two", "три")
+	if out := runCommands(t, state, "2V "+head+" "+tail); out != "8 7\n" {
+		t.Errorf("2V printed %q, want the two file sizes", out)
+	}
+	for fn, want := range map[string]string{head: "one\ntwo\n", tail: "три\n"} {
+		if data, err := os.ReadFile(fn); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", fn, data, err, want)
+		}
+	}
+	// буфер и текущая строка не меняются
+	if len(state.buffer) != 3 || state.current != 3 {
+		t.Errorf("after 2V: buffer %q, current %d", state.buffer, state.current)
+	}
+
+	// пустая часть записывается только с V!
+	for _, command := range []string{"0V", "$V"} {
+		os.Remove(head)
+		err := state.HandleCommand([]byte(command + " " + head + " " + tail))
+		if err == nil || err.Error() != "one of the parts is empty; use V! to write it" {
+			t.Errorf("%s = %v, want the empty part error", command, err)
+		}
+		if _, err := os.Stat(head); !os.IsNotExist(err) {
+			t.Errorf("%s wrote %s", command, head)
+		}
+	}
+	if out := runCommands(t, state, "$V! "+head+" "+tail); out != "15 0\n" {
+		t.Errorf("$V! printed %q", out)
+	}
+	if data, _ := os.ReadFile(tail); len(data) != 0 {
+		t.Errorf("$V!: %s = %q, want an empty file", tail, data)
+	}
+	if err := state.HandleCommand([]byte("V " + head)); err == nil {
+		t.Error("V with one file name succeeded, want error")
+	}
+}
+
+func TestQuietEmpty(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		for _, command := range []string{"p", "#", "F/x/"} {
+			state := newTestState()
+			state.quietEmpty = quiet
+			var err error
+			out := captureOutput(t, func() { err = state.HandleCommand([]byte(command)) })
+			// печатающие команды молчат на пустом буфере только с quietempty
+			if quiet && (err != nil || out != "") {
+				t.Errorf("quietempty: %s = %v, printed %q; want nothing", command, err, out)
+			}
+			if !quiet && !errors.Is(err, errEmptyBuffer) {
+				t.Errorf("%s on an empty buffer = %v, want errEmptyBuffer", command, err)
+			}
+		}
+		// изменяющие команды сообщают об ошибке всегда
+		state := newTestState()
+		state.quietEmpty = quiet
+		if err := state.HandleCommand([]byte("d")); !errors.Is(err, errEmptyBuffer) {
+			t.Errorf("quietempty %t: d on an empty buffer = %v, want errEmptyBuffer", quiet, err)
+		}
+	}
+
+	// на непустом буфере quietempty ничего не меняет
+	state := newTestState("a")
+	state.quietEmpty = true
+	if out := runCommands(t, state, "p", "#"); out != "a\n1   a\n" {
+		t.Errorf("quietempty on a non-empty buffer printed %q", out)
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	dir := t.TempDir()
+	for name, buffer := range map[string][]string{"nil.txt": nil, "empty.txt": {}} {
+		fn := filepath.Join(dir, name)
+		if err := writeFile(fn, buffer, writeOptions{crlf: true}); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(fn); err != nil || info.Size() != 0 {
+			t.Errorf("writeFile(%s) of an empty buffer: %v, %v; want a zero-byte file", name, info, err)
+		}
+	}
+
+	fn := filepath.Join(dir, "cmd.txt")
+	state := newTestState()
+	if out := runCommands(t, state, "w "+fn); out != "writing empty file\n" {
+		t.Errorf("w of an empty buffer printed %q", out)
+	}
+	if data, err := os.ReadFile(fn); err != nil || len(data) != 0 {
+		t.Errorf("%s = %q, %v; want a zero-byte file", fn, data, err)
+	}
+	// пустой файл читается как пустой буфер
+	runCommands(t, state, "e "+fn)
+	if len(state.buffer) != 0 || state.current != 0 {
+		t.Errorf("e of an empty file: buffer %q, current %d", state.buffer, state.current)
+	}
+}
+
+func TestPatternLines(t *testing.T) {
+	state := newTestState("foo", "foobar", " foo", "bar foo", "fo", "o")
+	if out := runCommands(t, state, "F/^foo$/"); out != "1   foo\n" {
+		t.Errorf("F/^foo$/ printed %q, want only the exact line", out)
+	}
+	if out := runCommands(t, state, "F/foo$/"); out != "1   foo\n3    foo\n4   bar foo\n" {
+		t.Errorf("F/foo$/ printed %q", out)
+	}
+	// шаблон применяется к каждой строке отдельно: . не захватывает перевод строки
+	for _, pattern := range []string{"/fo.o/", "/o.o/", `/fo\no/`, "/fo[^x]o/"} {
+		if out := runCommands(t, state, "F"+pattern); out != "" {
+			t.Errorf("F%s matched across lines: %q", pattern, out)
+		}
+	}
+	runCommands(t, state, "1")
+	if out := runCommands(t, state, "/^foo$/"); out != "foo\n" || state.current != 1 {
+		t.Errorf("/^foo$/ printed %q, current %d; want the only exact match", out, state.current)
+	}
+}
+
+func TestMoveCurrent(t *testing.T) {
+	state := newTestState("a", "b", "c", "d")
+	// M переносит текущую строку молча
+	if out := runCommands(t, state, "2M"); out != "" || state.current != 2 {
+		t.Errorf("2M printed %q, current %d; want nothing, 2", out, state.current)
+	}
+	if out := runCommands(t, state, "/d/M"); out != "" || state.current != 4 {
+		t.Errorf("/d/M printed %q, current %d; want nothing, 4", out, state.current)
+	}
+	if out := runCommands(t, state, "1,3M"); out != "" || state.current != 3 {
+		t.Errorf("1,3M printed %q, current %d; want nothing, 3", out, state.current)
+	}
+	runCommands(t, state, "$M")
+	// без адреса M остается на текущей строке
+	if out := runCommands(t, state, "M"); out != "" || state.current != 4 {
+		t.Errorf("M printed %q, current %d; want nothing, 4", out, state.current)
+	}
+	// одиночный адрес, напротив, печатает строку
+	if out := runCommands(t, state, "2"); out != "b\n" || state.current != 2 {
+		t.Errorf("2 printed %q, current %d; want b, 2", out, state.current)
+	}
+	if err := state.HandleCommand([]byte("9M")); err == nil {
+		t.Error("9M succeeded, want error")
+	}
+}
+
+func TestChangeCase(t *testing.T) {
+	buffer := []string{"école ÉTÉ naïve", "çava straße", "123 ---"}
+	tests := []struct {
+		command string
+		want    []string
+		out     string
+	}{
+		{"~u", []string{"ÉCOLE ÉTÉ NAÏVE", "ÇAVA STRAßE", "123 ---"}, "2\n"},
+		{"~l", []string{"école été naïve", "çava straße", "123 ---"}, "1\n"},
+		{"~t", []string{"École Été Naïve", "Çava Straße", "123 ---"}, "2\n"},
+		// с шаблоном меняются только совпадения
+		{"~u/é/", []string{"École ÉTÉ naïve", "çava straße", "123 ---"}, "1\n"},
+		{"~l/[ÉT]+/", []string{"école été naïve", "çava straße", "123 ---"}, "1\n"},
+		{"2~u/ç|ß/", []string{"école ÉTÉ naïve", "Çava straße", "123 ---"}, "1\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+	}
+}
+
+func TestIndentReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []string
+		out    string
+	}{
+		{"clean spaces", []string{"func f() {", "    if x {", "        y()", "    }", "", "}"}, "0\n"},
+		{"clean tabs", []string{"a", "\tb", "\t\tc", "\t  aligned", "d"}, "0\n"},
+		{"space before tab", []string{"a", "\tb", " \tc", "\td"}, "3   space before tab\n1\n"},
+		{"tab among spaces", []string{"a", "  b", "  c", "\td", "  e"}, "4   tab indent, mostly spaces\n1\n"},
+		{"space among tabs", []string{"a", "\tb", "\tc", "    d", "\te"}, "4   space indent, mostly tabs\n1\n"},
+		{"odd step", []string{"a", "    b", "        c", "     d", "    e", "f"}, "4   indent 5 is not a multiple of 4\n1\n"},
+		// пустые строки и строки из пробелов не проверяются
+		{"blank lines", []string{"a", "   ", "\t", "  b"}, "0\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(tt.buffer)...)
+		if out := runCommands(t, state, "B"); out != tt.out {
+			t.Errorf("%s: B printed %q, want %q", tt.name, out, tt.out)
+		}
+		if !slices.Equal(state.buffer, tt.buffer) || state.changed {
+			t.Errorf("%s: B changed the buffer", tt.name)
+		}
+	}
+}
+
+func TestBracketedPaste(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+		mode  Mode
+	}{
+		// строка "." внутри вставки - текст
+		{"dot inside paste", []string{"a", "\x1b[200~first", ".", "last\x1b[201~", "."},
+			[]string{"first", ".", "last"}, modeCommand},
+		{"dot line pasted alone", []string{"a", "\x1b[200~.\x1b[201~", "."},
+			[]string{"."}, modeCommand},
+		{"paste still open", []string{"a", "\x1b[200~x", "."},
+			[]string{"x", "."}, modeAppend},
+		// конец вставки в начале строки: "." набрана после вставки
+		{"dot typed after paste", []string{"a", "\x1b[200~x", "\x1b[201~."},
+			[]string{"x"}, modeCommand},
+		// вставка в командном режиме - это команды вместе с завершающей точкой
+		{"pasted commands", []string{"\x1b[200~a", "text", ".\x1b[201~"},
+			[]string{"text"}, modeCommand},
+	}
+	for _, tt := range tests {
+		state := newTestState()
+		runCommands(t, state, tt.lines...)
+		if !slices.Equal(state.buffer, tt.want) || state.mode != tt.mode {
+			t.Errorf("%s: buffer %q, mode %v; want %q, %v", tt.name, state.buffer, state.mode, tt.want, tt.mode)
+		}
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	buffer := []string{"1. one", "2. two", "5. five", "   1) sub a", "   3) sub b", "text", "10. ten"}
+	tests := []struct {
+		command string
+		want    []string
+		out     string
+	}{
+		// пропуски в нумерации убираются, вложенный список нумеруется отдельно
+		{"Q", []string{"1. one", "2. two", "3. five", "   1) sub a", "   2) sub b", "text", "4. ten"}, "3\n"},
+		{"Q 0", []string{"0. one", "1. two", "2. five", "   0) sub a", "   1) sub b", "text", "3. ten"}, "6\n"},
+		{"3,5Q 7", []string{"1. one", "2. two", "7. five", "   7) sub a", "   8) sub b", "text", "10. ten"}, "3\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+	}
+
+	// стиль знака после номера сохраняется у каждого пункта
+	state := newTestState("3) a", "9. b", "x) c")
+	runCommands(t, state, "Q")
+	if !slices.Equal(state.buffer, []string{"1) a", "2. b", "x) c"}) {
+		t.Errorf("Q with mixed styles: buffer %q", state.buffer)
+	}
+}
+
+func TestSqueezeBlank(t *testing.T) {
+	buffer := []string{"x", "", "", "  ", "y", "\t", "z", "", ""}
+	tests := []struct {
+		command string
+		want    []string
+		out     string
+	}{
+		// серии пустых строк схлопываются в одну, строки из пробелов тоже пустые
+		{"z", []string{"x", "", "y", "\t", "z", ""}, "3\n"},
+		{"z a", []string{"x", "y", "z"}, "6\n"},
+		// с e пустая только строка без символов
+		{"z e", []string{"x", "", "  ", "y", "\t", "z", ""}, "2\n"},
+		{"z ae", []string{"x", "  ", "y", "\t", "z"}, "4\n"},
+		{"1,4z", []string{"x", "", "y", "\t", "z", "", ""}, "2\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+	}
+}
+
+func TestAutoPrint(t *testing.T) {
+	tests := []struct {
+		commands []string
+		out      string // с o autoprint
+		plain    string // без него
+	}{
+		// после изменения буфера печатается новая текущая строка
+		{[]string{"2d"}, "3\n", ""},
+		{[]string{"$d"}, "3\n", ""},
+		{[]string{"1,2j"}, "12\n", ""},
+		{[]string{"a", "new", "."}, "new\n", ""},
+		{[]string{`1a\x`}, "x\n", ""},
+		// печатающие команды и переходы не печатают строку второй раз
+		{[]string{"2p"}, "2\n", "2\n"},
+		{[]string{"2"}, "2\n", "2\n"},
+		{[]string{"1,2#"}, "1   1\n2   2\n", "1   1\n2   2\n"},
+		// команда, не изменившая буфер, ничего не добавляет
+		{[]string{"X/nothing/"}, "0\n", "0\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState("1", "2", "3", "4")
+		state.autoPrint = true
+		if out := runCommands(t, state, tt.commands...); out != tt.out {
+			t.Errorf("%q with autoprint printed %q, want %q", tt.commands, out, tt.out)
+		}
+		state = newTestState("1", "2", "3", "4")
+		if out := runCommands(t, state, tt.commands...); out != tt.plain {
+			t.Errorf("%q without autoprint printed %q, want %q", tt.commands, out, tt.plain)
+		}
+	}
+}
+
+func TestReplaceFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"crlf.txt":   "foo a\r\nbar\r\nfoo foo",
+		"lf.txt":     "one foo\ntwo\n",
+		"none.txt":   "nothing here\n",
+		"binary.txt": "foo\x00bin",
+		"other.md":   "foo\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := newTestState("foo")
+	out := runCommands(t, state, "x/f(o+)/[&\\1]/g "+filepath.Join(dir, "*.txt"))
+	for _, want := range []string{"binary.txt: skipped, binary file\n", "crlf.txt: 2\n", "lf.txt: 1\n", "none.txt: 0\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("x printed %q, want %q", out, want)
+		}
+	}
+
+	// окончания строк и отсутствие перевода строки в конце сохраняются
+	want := map[string]string{
+		"crlf.txt":   "[foooo] a\r\nbar\r\n[foooo] [foooo]",
+		"lf.txt":     "one [foooo]\ntwo\n",
+		"none.txt":   "nothing here\n",
+		"binary.txt": "foo\x00bin",
+		"other.md":   "foo\n",
+	}
+	for name, data := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != data {
+			t.Errorf("%s = %q, %v; want %q", name, got, err, data)
+		}
+	}
+	if !slices.Equal(state.buffer, []string{"foo"}) || state.changed {
+		t.Errorf("x changed the buffer: %q", state.buffer)
+	}
+
+	// без g заменяется только первое совпадение в строке
+	runCommands(t, state, "x/\\[foooo\\]/foo/ "+filepath.Join(dir, "crlf.txt"))
+	if got, _ := os.ReadFile(filepath.Join(dir, "crlf.txt")); string(got) != "foo a\r\nbar\r\nfoo [foooo]" {
+		t.Errorf("x without g: crlf.txt = %q", got)
+	}
+}
+
+func TestPager(t *testing.T) {
+	captured := filepath.Join(t.TempDir(), "paged")
+	t.Setenv("PAGER", "tee "+captured)
+	state := newTestState("one", "two", "three")
+	state.current = 1
+	out := runCommands(t, state, "2,3v")
+	data, err := os.ReadFile(captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "two\nthree\n" || out != "two\nthree\n" {
+		t.Errorf("pager got %q and printed %q, want the range", data, out)
+	}
+	if state.current != 1 || state.changed {
+		t.Errorf("v changed the state: current %d, changed %t", state.current, state.changed)
+	}
+
+	// программу просмотра не удалось запустить: строки печатаются, как p
+	t.Setenv("PAGER", filepath.Join(t.TempDir(), "no-such-pager"))
+	if out := runCommands(t, state, "v"); out != "one\ntwo\nthree\n" {
+		t.Errorf("v with a missing pager printed %q", out)
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	// "привет мир" - 10 символов, но 19 байт
+	buffer := []string{"привет мир", "абвгдежзийк", "short", "日本語日本語日本語日本"}
+	state := newTestState(slices.Clone(buffer)...)
+	if out := runCommands(t, state, "k 10"); out != "2   11\n4   11\n" {
+		t.Errorf("k 10 printed %q", out)
+	}
+	if !slices.Equal(state.buffer, buffer) || state.changed {
+		t.Errorf("k 10 changed the buffer: %q", state.buffer)
+	}
+	if out := runCommands(t, state, "k 11"); out != "" {
+		t.Errorf("k 11 printed %q, want nothing", out)
+	}
+
+	// w переносит ровно по ширине, не разрывая символы
+	if out := runCommands(t, state, "k 10 w"); out != "2\n" {
+		t.Errorf("k 10 w printed %q", out)
+	}
+	want := []string{"привет мир", "абвгдежзий", "к", "short", "日本語日本語日本語日", "本"}
+	if !slices.Equal(state.buffer, want) {
+		t.Errorf("after k 10 w: buffer %q, want %q", state.buffer, want)
+	}
+	for _, line := range state.buffer {
+		if !utf8.ValidString(line) {
+			t.Errorf("k w split a character: %q", line)
+		}
+	}
+	if out := runCommands(t, state, "k 10"); out != "" {
+		t.Errorf("k 10 after k 10 w printed %q", out)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	state := newTestState("a", "b", "b")
+	runCommands(t, state, "o readonly on")
+	for _, command := range []string{"d", "1,2j", "a", `a\x`, "U", "~u", "w " + filepath.Join(dir, "out.txt"), "r " + filepath.Join(dir, "x")} {
+		if err := state.HandleCommand([]byte(command)); !errors.Is(err, errReadOnly) {
+			t.Errorf("%s in read-only mode = %v, want errReadOnly", command, err)
+		}
+	}
+	if !slices.Equal(state.buffer, []string{"a", "b", "b"}) || state.changed || state.mode != modeCommand {
+		t.Errorf("read-only buffer changed: %q", state.buffer)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.txt")); !os.IsNotExist(err) {
+		t.Error("w wrote a file in read-only mode")
+	}
+	// команды, которые только читают, работают
+	if out := runCommands(t, state, "1p", "F/b/", "=", "U c", "f"); out != "a\n2   b\n3   b\n3\n1\n(no file): 3 lines, line 1, unmodified, utf-8, LF\n" {
+		t.Errorf("read commands printed %q", out)
+	}
+	runCommands(t, state, "o readonly off", "d")
+	if len(state.buffer) != 2 {
+		t.Errorf("d after o readonly off: buffer %q", state.buffer)
+	}
+
+	// файл без права записи открывается только для чтения
+	fn := filepath.Join(dir, "locked.txt")
+	if err := os.WriteFile(fn, []byte("x\n"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	state = newTestState()
+	if out := runCommands(t, state, "e "+fn); out != fn+": read-only\n" || !state.readOnly {
+		t.Errorf("e of a 0444 file printed %q, readOnly %t", out, state.readOnly)
+	}
+	if err := state.HandleCommand([]byte("d")); !errors.Is(err, errReadOnly) {
+		t.Errorf("d after e of a 0444 file = %v, want errReadOnly", err)
+	}
+	// следующий файл с правом записи снимает флаг
+	writable := filepath.Join(dir, "open.txt")
+	if err := os.WriteFile(writable, []byte("y\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runCommands(t, state, "e "+writable)
+	if state.readOnly {
+		t.Error("e of a writable file kept the read-only flag")
+	}
+}
+
+func TestTagLines(t *testing.T) {
+	buffer := []string{"12:30 start", "no time", "at 09:15 end id=7"}
+	tests := []struct {
+		command string
+		want    []string
+		out     string
+	}{
+		{`t/(\d\d):(\d\d)/`, []string{"12:30 start 12", "no time", "at 09:15 end id=7 09"}, "2\n"},
+		{`t/(\d\d):(\d\d)/2`, []string{"12:30 start 30", "no time", "at 09:15 end id=7 15"}, "2\n"},
+		{`t/(\d\d:\d\d)/^1`, []string{"12:30 12:30 start", "no time", "09:15 at 09:15 end id=7"}, "2\n"},
+		{`t/id=(?P<id>\d+)/id`, []string{"12:30 start", "no time", "at 09:15 end id=7 7"}, "1\n"},
+		{`t/id=(?P<id>\d+)/^id`, []string{"12:30 start", "no time", "7 at 09:15 end id=7"}, "1\n"},
+		{`t/nothing(x)/`, buffer, "0\n"},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		out := runCommands(t, state, tt.command)
+		if !slices.Equal(state.buffer, tt.want) {
+			t.Errorf("%s: buffer %q, want %q", tt.command, state.buffer, tt.want)
+		}
+		if out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+	}
+
+	state := newTestState("a1")
+	for _, command := range []string{`t/(\d)/2`, `t/(\d)/name`, `t/[/`} {
+		if err := state.HandleCommand([]byte(command)); err == nil {
+			t.Errorf("%s succeeded, want error", command)
+		}
+	}
+}
+
+func TestListDuplicates(t *testing.T) {
+	buffer := []string{"b", "a", "b", "c", "a", "b", "", ""}
+	tests := []struct {
+		command string
+		out     string
+	}{
+		// повторы в порядке первого появления, номера строк буфера
+		{"U l", "1,3,6: b\n2,5: a\n7,8: \n"},
+		{"3,6U l", "3,6: b\n"},
+		{"1,2U l", ""},
+	}
+	for _, tt := range tests {
+		state := newTestState(slices.Clone(buffer)...)
+		if out := runCommands(t, state, tt.command); out != tt.out {
+			t.Errorf("%s printed %q, want %q", tt.command, out, tt.out)
+		}
+		if !slices.Equal(state.buffer, buffer) || state.changed {
+			t.Errorf("%s changed the buffer", tt.command)
+		}
+	}
+}
+
+func TestRepeatCommand(t *testing.T) {
+	state := newTestState("x1", "a", "x2", "b", "x3")
+	state.current = 1
+	// & после /re/ переходит к следующему совпадению и по кругу
+	out := runCommands(t, state, "/x/", "&", "&")
+	if out != "x2\nx3\nx1\n" || state.current != 1 {
+		t.Errorf("/x/ and & printed %q, current %d", out, state.current)
+	}
+
+	// & после d удаляет следующую строку
+	state = newTestState("1", "2", "3", "4", "5")
+	runCommands(t, state, "2", "d", "&", "&")
+	if !slices.Equal(state.buffer, []string{"1", "5"}) || state.current != 2 {
+		t.Errorf("d and &: buffer %q, current %d", state.buffer, state.current)
+	}
+
+	// адрес с поиском вычисляется заново
+	state = newTestState("keep", "del 1", "keep", "del 2", "keep")
+	state.current = 1
+	runCommands(t, state, "/del/d", "&")
+	if !slices.Equal(state.buffer, []string{"keep", "keep", "keep"}) {
+		t.Errorf("/del/d and &: buffer %q", state.buffer)
+	}
+	if err := state.HandleCommand([]byte("&")); err == nil {
+		t.Error("& with no more matches succeeded, want error")
+	}
+}
+
+func TestStripEscapes(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"plain text [31m no escape", "plain text [31m no escape"},
+		{"\x1b[1;31mbold red\x1b[0m", "bold red"},
+		// вложенные и идущие подряд последовательности
+		{"\x1b[1m\x1b[4m\x1b[31mx\x1b[0m\x1b[0m", "x"},
+		{"\x1b]0;title\x07text", "text"},
+		{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"\x1b[2K\x1b[Gline", "line"},
+		{"\x1b(Bascii\x1b(B\x1b[m", "ascii"},
+		// оборванная последовательность: удаляется ее начало
+		{"cut\x1b", "cut"},
+		{"cut\x1b[", "cut"},
+		{"a\x1b[12", "a12"},
+	}
+	for _, tt := range tests {
+		state := newTestState(tt.line)
+		runCommands(t, state, "N a")
+		if state.buffer[0] != tt.want {
+			t.Errorf("N a on %q = %q, want %q", tt.line, state.buffer[0], tt.want)
+		}
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "text.txt")
+	if err := os.WriteFile(fn, []byte("one\ntwo\nthree\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := newTestState()
+	runCommands(t, state, "e "+fn, `2a\new`, "1d")
+
+	// D n - диапазон одним блоком добавленных строк с номерами в буфере
+	out := runCommands(t, state, "2,3D n")
+	want := "--- /dev/null\n+++ " + fn + "\n@@ -0,0 +2,2 @@\n+new\n+three\n"
+	if out != want {
+		t.Errorf("2,3D n printed %q, want %q", out, want)
+	}
+	out = runCommands(t, state, "D n")
+	want = "--- /dev/null\n+++ " + fn + "\n@@ -0,0 +1,3 @@\n+two\n+new\n+three\n"
+	if out != want {
+		t.Errorf("D n printed %q, want %q", out, want)
+	}
+
+	// отличия от файла: - удаленные, + добавленные, пробел - контекст
+	out = runCommands(t, state, "D 1")
+	want = "--- " + fn + "\n+++ " + fn + " (buffer)\n@@ -1,3 +1,3 @@\n-one\n two\n+new\n three\n"
+	if out != want {
+		t.Errorf("D 1 printed %q, want %q", out, want)
+	}
+
+	// без имени файла D n подписывает буфер
+	state = newTestState("x", "y")
+	if out := runCommands(t, state, "2D n"); out != "--- /dev/null\n+++ (buffer)\n@@ -0,0 +2,1 @@\n+y\n" {
+		t.Errorf("2D n without a file printed %q", out)
+	}
+	if err := state.HandleCommand([]byte("D")); err == nil {
+		t.Error("D without a file succeeded, want error")
+	}
+}